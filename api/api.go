@@ -2,21 +2,80 @@ package api
 
 import (
 	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// ValidationError represents a field that is too long
-type ValidationError string
+// Validation error reasons
+const (
+	ReasonTooLong          = "too_long"
+	ReasonInvalidAddress   = "invalid_address"
+	ReasonInvalidMAC       = "invalid_mac"
+	ReasonInvalidKey       = "invalid_key"
+	ReasonInvalidType      = "invalid_type"
+	ReasonInvalidJSON      = "invalid_json"
+	ReasonMissing          = "missing"
+	ReasonInFuture         = "in_future"
+	ReasonTooOld           = "too_old"
+	ReasonInvalidToken     = "invalid_token"
+	ReasonInvalidSignature = "invalid_signature"
+	ReasonReplayed         = "replayed"
+)
+
+// ValidationError represents a field of a submitted Entry that is invalid.
+// Field is the JSON name of the field, and Limit is the maximum length of the field if it has one
+type ValidationError struct {
+	Field  string `json:"field,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Reason string `json:"reason"`
+}
 
-func (v ValidationError) Error() string {
-	return "Field " + string(v) + " is too long"
+func (v *ValidationError) Error() string {
+	switch {
+	case v.Field == "":
+		return "Invalid entry: " + v.Reason
+	case v.Limit != 0:
+		return fmt.Sprintf("Field %s is invalid: %s (limit %d)", v.Field, v.Reason, v.Limit)
+	}
+	return "Field " + v.Field + " is invalid: " + v.Reason
+}
+
+// ValidationErrors is a list of every invalid field of an Entry
+type ValidationErrors []*ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for idx, err := range v {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// decodeError returns the ValidationErrors for an error returned while decoding a JSON Entry
+func decodeError(err error) ValidationErrors {
+	var tErr *json.UnmarshalTypeError
+	if errors.As(err, &tErr) {
+		return ValidationErrors{{Field: tErr.Field, Reason: ReasonInvalidType}}
+	}
+	return ValidationErrors{{Reason: ReasonInvalidJSON}}
 }
 
 func checkLength(s string, l int) bool {
 	return len(s) <= l
 }
 
+func checkIP(s string) bool {
+	_, err := parseIP(s)
+	return err == nil
+}
+
 // Hash is an MD5 hash
 type Hash [md5.Size]byte
 
@@ -40,34 +99,178 @@ type Entry struct {
 	IP               string    `json:"ip"`
 	InternetIP       string    `json:"internet_ip,omitempty"`
 	Time             time.Time `json:"time,omitempty"`
+
+	//platform fields, sent by newer clients
+	OSVersion     string   `json:"os_version,omitempty"`
+	OSBuild       string   `json:"os_build,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	ClientVersion string   `json:"client_version,omitempty"`
+	MACAddresses  []string `json:"mac_addresses,omitempty"`
+
+	//custom facts
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	//position in the spool the Entry was read from, if any
+	spooled spoolRef
+
+	//log id the Entry was read from, if any
+	logID int64
 }
 
 // Hashes generates and returns the user, device, address, and identity hashes for an Entry
 func (e *Entry) Hashes() (user Hash, device Hash, address Hash, identity Hash) {
 	u := NewHash(strconv.Itoa(int(e.UID)), e.Username, e.FullName)
 	d := NewHash(e.Serial, e.ClientIdentifier, e.Hostname)
-	a := NewHash(e.IP, e.InternetIP)
+	a := NewHash(normalizeIP(e.IP), normalizeIP(e.InternetIP))
 	i := NewHash(string(u[:]), string(d[:]), string(a[:]))
 	return u, d, a, i
 }
 
-// Validate checks that the given Entry's fields fit in the DB
+// entryField is a length-limited string field of an Entry
+type entryField struct {
+	name  string
+	value *string
+	limit int
+}
+
+// fields returns e's length-limited string fields by JSON name
+func (e *Entry) fields() []entryField {
+	return []entryField{
+		{"username", &e.Username, 64},
+		{"full_name", &e.FullName, 128},
+		{"serial", &e.Serial, 32},
+		{"client_identifier", &e.ClientIdentifier, 64},
+		{"hostname", &e.Hostname, 32},
+		{"os_version", &e.OSVersion, 32},
+		{"os_build", &e.OSBuild, 32},
+		{"model", &e.Model, 64},
+		{"client_version", &e.ClientVersion, 32},
+	}
+}
+
+// maxMACAddresses is the most MAC addresses that fit in platform.mac_addresses
+const maxMACAddresses = 14
+
+// macAddresses returns e's valid MAC addresses in canonical form, sorted and joined by commas
+func (e *Entry) macAddresses() string {
+	macs := make([]string, 0, len(e.MACAddresses))
+	seen := make(map[string]bool)
+	for _, s := range e.MACAddresses {
+		mac, err := net.ParseMAC(strings.TrimSpace(s))
+		if err != nil || seen[mac.String()] {
+			continue
+		}
+		seen[mac.String()] = true
+		macs = append(macs, mac.String())
+	}
+	sort.Strings(macs)
+	return strings.Join(macs, ",")
+}
+
+// hasPlatform returns true if any of e's platform fields are set
+func (e *Entry) hasPlatform() bool {
+	return e.OSVersion != "" || e.OSBuild != "" || e.Model != "" || e.ClientVersion != "" || len(e.MACAddresses) != 0
+}
+
+// PlatformHash returns the hash of e's platform fields. ok is false if none are set
+func (e *Entry) PlatformHash() (h Hash, ok bool) {
+	if !e.hasPlatform() {
+		return h, false
+	}
+	return NewHash(e.OSVersion, "\x00", e.OSBuild, "\x00", e.Model, "\x00", e.ClientVersion, "\x00", e.macAddresses()), true
+}
+
+// Attribute limits. maxAttributes only counts submitted attributes, not reservedAttributes added by the server after validation
+const (
+	maxAttributes     = 32
+	maxAttributeKey   = 64
+	maxAttributeValue = 255
+)
+
+// reservedAttributes are set by the server to record how an entry was submitted
+var reservedAttributes = []string{TokenAttribute, SignatureAttribute, ClientCertAttribute}
+
+// removeReservedAttributes removes any submitted values for reservedAttributes from e, so clients can't forge them.
+// It's called before e is validated, whether or not the features that set them are enabled
+func (e *Entry) removeReservedAttributes() {
+	for _, key := range reservedAttributes {
+		delete(e.Attributes, key)
+	}
+}
+
+// attributeHash returns the hash of a single attribute
+func attributeHash(key, value string) Hash {
+	return NewHash("attribute\x00", key, "\x00", value)
+}
+
+// attributeKeys returns the sorted keys of e's attributes
+func (e *Entry) attributeKeys() []string {
+	keys := make([]string, 0, len(e.Attributes))
+	for key := range e.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AttributesHash returns the hash of e's attributes. ok is false if e has none
+func (e *Entry) AttributesHash() (h Hash, ok bool) {
+	if len(e.Attributes) == 0 {
+		return h, false
+	}
+	args := []string{"attributes"}
+	for _, key := range e.attributeKeys() {
+		args = append(args, "\x00", key, "\x00", e.Attributes[key])
+	}
+	return NewHash(args...), true
+}
+
+// validateAttributes returns the ValidationErrors for e's attributes
+func (e *Entry) validateAttributes() ValidationErrors {
+	var errs ValidationErrors
+	if len(e.Attributes) > maxAttributes {
+		errs = append(errs, &ValidationError{Field: "attributes", Limit: maxAttributes, Reason: ReasonTooLong})
+	}
+	for _, key := range e.attributeKeys() {
+		if key == "" || !checkLength(key, maxAttributeKey) {
+			errs = append(errs, &ValidationError{Field: "attributes", Limit: maxAttributeKey, Reason: ReasonInvalidKey})
+			continue
+		}
+		if !checkLength(e.Attributes[key], maxAttributeValue) {
+			errs = append(errs, &ValidationError{Field: "attributes." + key, Limit: maxAttributeValue, Reason: ReasonTooLong})
+		}
+	}
+	return errs
+}
+
+// Validate checks that the given Entry's fields fit in the DB.
+// If any don't, a ValidationErrors with every invalid field is returned
 func (e *Entry) Validate() error {
-	switch {
-	case !checkLength(e.Username, 64):
-		return ValidationError(e.Username)
-	case !checkLength(e.FullName, 128):
-		return ValidationError(e.FullName)
-	case !checkLength(e.Serial, 32):
-		return ValidationError(e.Serial)
-	case !checkLength(e.ClientIdentifier, 64):
-		return ValidationError(e.ClientIdentifier)
-	case !checkLength(e.Hostname, 32):
-		return ValidationError(e.Hostname)
-	case !checkLength(e.IP, 15):
-		return ValidationError(e.IP)
-	case !checkLength(e.InternetIP, 15):
-		return ValidationError(e.InternetIP)
+	var errs ValidationErrors
+	for _, f := range e.fields() {
+		if !checkLength(*f.value, f.limit) {
+			errs = append(errs, &ValidationError{Field: f.name, Limit: f.limit, Reason: ReasonTooLong})
+		}
+	}
+	if !checkIP(e.IP) {
+		errs = append(errs, &ValidationError{Field: "ip", Reason: ReasonInvalidAddress})
+	}
+	if !checkIP(e.InternetIP) {
+		errs = append(errs, &ValidationError{Field: "internet_ip", Reason: ReasonInvalidAddress})
+	}
+	for _, s := range e.MACAddresses {
+		if _, err := net.ParseMAC(strings.TrimSpace(s)); err != nil {
+			errs = append(errs, &ValidationError{Field: "mac_addresses", Reason: ReasonInvalidMAC})
+			break
+		}
+	}
+	if len(e.MACAddresses) > maxMACAddresses {
+		errs = append(errs, &ValidationError{Field: "mac_addresses", Limit: maxMACAddresses, Reason: ReasonTooLong})
+	}
+	errs = append(errs, e.validateAttributes()...)
+
+	if len(errs) != 0 {
+		return errs
 	}
 	return nil
 }
@@ -91,8 +294,33 @@ type Device struct {
 // Address represents a set of IP Addresses
 type Address struct {
 	ID         int
-	IP         string
-	InternetIP string
+	IP         netip.Addr
+	InternetIP netip.Addr
+}
+
+// Platform represents the OS, hardware, and client software of a device at the time of an event
+type Platform struct {
+	ID            int
+	OSVersion     string
+	OSBuild       string
+	Model         string
+	ClientVersion string
+	MACAddresses  string
+}
+
+// Attribute represents a custom key/value fact. Hash is the Attribute's cache key
+type Attribute struct {
+	ID    int
+	Name  string
+	Value string
+	Hash  Hash
+}
+
+// AttributeSet represents a unique set of Attributes
+type AttributeSet struct {
+	ID         int
+	Hash       Hash
+	Attributes []*Attribute
 }
 
 // Identity represents a unique set of User, Device, and Address
@@ -105,7 +333,9 @@ type Identity struct {
 
 // LogEntry represents an event
 type LogEntry struct {
-	ID         int64
-	IdentityID int
-	Time       time.Time
+	ID             int64
+	IdentityID     int
+	PlatformID     int
+	AttributeSetID int
+	Time           time.Time
 }
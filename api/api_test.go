@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateIP(t *testing.T) {
+	tests := []struct {
+		ip, internetIP string
+		valid          bool
+	}{
+		{"10.0.0.1", "1.2.3.4", true},
+		{"", "1.2.3.4", true},
+		{"fe80::1%en0", "2001:db8:85a3::8a2e:370:7334", true},
+		{"::ffff:10.0.0.1", "2001:db8::1", true},
+		{"10.0.0.1", "1.2.3.4, 10.0.0.1", false},
+		{"localhost", "1.2.3.4", false},
+	}
+	for _, test := range tests {
+		e := &Entry{IP: test.ip, InternetIP: test.internetIP}
+		err := e.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s, %s: unexpected error: %v", test.ip, test.internetIP, err)
+		}
+		var errs ValidationErrors
+		if !test.valid && (!errors.As(err, &errs) || errs[0].Reason != ReasonInvalidAddress) {
+			t.Errorf("%s, %s: expected invalid address error, got %v", test.ip, test.internetIP, err)
+		}
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	e := &Entry{
+		Username: strings.Repeat("u", 65),
+		Serial:   "SERIAL1",
+		Hostname: strings.Repeat("h", 33),
+		IP:       "localhost",
+	}
+	err := e.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	expected := ValidationErrors{
+		{Field: "username", Limit: 64, Reason: ReasonTooLong},
+		{Field: "hostname", Limit: 32, Reason: ReasonTooLong},
+		{Field: "ip", Reason: ReasonInvalidAddress},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for idx := range expected {
+		if *errs[idx] != *expected[idx] {
+			t.Errorf("expected %#v, got %#v", expected[idx], errs[idx])
+		}
+	}
+
+	e = &Entry{MACAddresses: []string{"aa:bb:cc:dd:ee:ff", "not a mac"}}
+	if err = e.Validate(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].Reason != ReasonInvalidMAC {
+		t.Errorf("expected invalid MAC error, got %v", err)
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	attrs := map[string]string{"lab": strings.Repeat("v", 256), "": "empty"}
+	for i := 0; i < maxAttributes; i++ {
+		attrs[strings.Repeat("k", i+1)] = "v"
+	}
+	err := (&Entry{Attributes: attrs}).Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	expected := ValidationErrors{
+		{Field: "attributes", Limit: maxAttributes, Reason: ReasonTooLong},
+		{Field: "attributes", Limit: maxAttributeKey, Reason: ReasonInvalidKey},
+		{Field: "attributes.lab", Limit: maxAttributeValue, Reason: ReasonTooLong},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for idx := range expected {
+		if *errs[idx] != *expected[idx] {
+			t.Errorf("expected %#v, got %#v", expected[idx], errs[idx])
+		}
+	}
+
+	h1, _ := (&Entry{Attributes: map[string]string{"a": "1", "b": "2"}}).AttributesHash()
+	h2, _ := (&Entry{Attributes: map[string]string{"b": "2", "a": "1"}}).AttributesHash()
+	h3, _ := (&Entry{Attributes: map[string]string{"a": "12"}}).AttributesHash()
+	if h1 != h2 || h1 == h3 {
+		t.Error("expected attribute hashes to only depend on keys and values")
+	}
+}
+
+func TestPlatformHash(t *testing.T) {
+	if _, ok := (&Entry{Serial: "SERIAL1"}).PlatformHash(); ok {
+		t.Error("expected entry without platform fields to have no platform hash")
+	}
+	h1, _ := (&Entry{Model: "Mac14,2", MACAddresses: []string{"AA:BB:CC:DD:EE:FF", "00:11:22:33:44:55"}}).PlatformHash()
+	h2, _ := (&Entry{Model: "Mac14,2", MACAddresses: []string{"00-11-22-33-44-55", "aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:ff"}}).PlatformHash()
+	if h1 != h2 {
+		t.Error("expected equivalent MAC addresses to have the same hash")
+	}
+}
+
+func TestHashesNormalizeIP(t *testing.T) {
+	_, _, a1, _ := (&Entry{IP: "::ffff:10.0.0.1", InternetIP: "2001:DB8::1"}).Hashes()
+	_, _, a2, _ := (&Entry{IP: "10.0.0.1", InternetIP: "2001:db8::1"}).Hashes()
+	if a1 != a2 {
+		t.Error("expected equivalent addresses to have the same hash")
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+// API key scopes. ScopeAdmin grants every other scope
+const (
+	ScopeSubmit Scope = "submit"
+	ScopeQuery  Scope = "query"
+	ScopeExport Scope = "export"
+	ScopeAdmin  Scope = "admin"
+)
+
+// ParseScopes parses a list of scope names
+func ParseScopes(names []string) ([]Scope, error) {
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		switch s := Scope(strings.TrimSpace(name)); s {
+		case ScopeSubmit, ScopeQuery, ScopeExport, ScopeAdmin:
+			scopes = append(scopes, s)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown scope: %s", name)
+		}
+	}
+	return scopes, nil
+}
+
+// APIKey is a named key used to authenticate requests
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Revoked   bool       `json:"revoked"`
+}
+
+// HasScope returns true if k grants scope
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns true if k has expired by now
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// API key errors
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrExpiredAPIKey = errors.New("expired api key")
+	ErrRevokedAPIKey = errors.New("revoked api key")
+	ErrUnknownKey    = errors.New("no api key with that name")
+)
+
+// keyPrefix is prepended to generated keys to make them easy to recognize
+const keyPrefix = "chr_"
+
+// newSecret returns a new random secret with the given prefix
+func newSecret(prefix string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashKey returns the hex SHA-256 hash of key as stored in the database. It's also used for enrollment secrets and device tokens
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// joinScopes returns scopes as stored in the database
+func joinScopes(scopes []Scope) string {
+	names := make([]string, len(scopes))
+	for idx, s := range scopes {
+		names[idx] = string(s)
+	}
+	return strings.Join(names, ",")
+}
+
+// CreateAPIKey generates and stores a new API key and returns it. Only its hash is stored, so the key can't be retrieved later.
+// If expires is zero, the key doesn't expire
+func (db *DB) CreateAPIKey(name string, scopes []Scope, expires time.Time) (string, *APIKey, error) {
+	key, err := newSecret(keyPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate key: %w", err)
+	}
+
+	k := &APIKey{Name: name, Scopes: scopes, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	var expiresAt interface{}
+	if !expires.IsZero() {
+		t := expires.UTC()
+		k.ExpiresAt, expiresAt = &t, t
+	}
+
+	stmt, err := db.DB.Prepare(db.dialect.insert("INSERT INTO api_key(name, key_hash, scopes, created_at, expires_at, revoked) VALUES(?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	if k.ID, err = db.dialect.insertID(stmt, name, hashKey(key), joinScopes(scopes), k.CreatedAt, expiresAt, false); err != nil {
+		return "", nil, fmt.Errorf("could not insert api key: %w", err)
+	}
+
+	return key, k, nil
+}
+
+const apiKeyColumns = "id, name, scopes, created_at, expires_at, revoked"
+
+// scanAPIKey scans a row of apiKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var (
+		k       = new(APIKey)
+		scopes  string
+		expires sql.NullTime
+	)
+	if err := row.Scan(&(k.ID), &(k.Name), &scopes, &(k.CreatedAt), &expires, &(k.Revoked)); err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(scopes, ",") {
+		if s != "" {
+			k.Scopes = append(k.Scopes, Scope(s))
+		}
+	}
+	k.CreatedAt = k.CreatedAt.UTC()
+	if expires.Valid {
+		t := expires.Time.UTC()
+		k.ExpiresAt = &t
+	}
+	return k, nil
+}
+
+// ListAPIKeys returns every API key, including expired and revoked keys, ordered by name
+func (db *DB) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := db.DB.Query("SELECT " + apiKeyColumns + " FROM api_key ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan row: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan rows: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks the named API key as revoked. Revoking a key that's already revoked does nothing
+func (db *DB) RevokeAPIKey(name string) error {
+	res, err := db.DB.Exec(db.dialect.rebind("UPDATE api_key SET revoked=? WHERE name=? AND revoked=?"), true, name, false)
+	if err != nil {
+		return fmt.Errorf("could not update api key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not update api key: %w", err)
+	}
+	if n != 0 {
+		return nil
+	}
+
+	//no rows are updated if the key is missing or already revoked
+	var id int
+	err = db.DB.QueryRow(db.dialect.rebind("SELECT id FROM api_key WHERE name=?"), name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrUnknownKey
+	}
+	if err != nil {
+		return fmt.Errorf("could not query api key: %w", err)
+	}
+	return nil
+}
+
+// getAPIKey returns the API key with the given key hash, or nil if it doesn't exist
+func (db *DB) getAPIKey(hash string) (*APIKey, error) {
+	k, err := scanAPIKey(db.DB.QueryRow(db.dialect.rebind("SELECT "+apiKeyColumns+" FROM api_key WHERE key_hash=?"), hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not query api key: %w", err)
+	}
+	return k, nil
+}
+
+// defaultKeyTTL is how long KeyStore caches keys if not configured
+const defaultKeyTTL = time.Minute
+
+type cachedKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// KeyStore authenticates API keys stored in the database.
+// Found keys are cached, so revoking a key can take up to the cache TTL to take effect
+type KeyStore struct {
+	db  *DB
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedKey
+}
+
+// NewKeyStore returns a new KeyStore that caches keys for ttl; default: 1 minute
+func NewKeyStore(db *DB, ttl time.Duration) *KeyStore {
+	if ttl <= 0 {
+		ttl = defaultKeyTTL
+	}
+	return &KeyStore{db: db, ttl: ttl, cache: make(map[string]*cachedKey)}
+}
+
+// Authenticate returns the API key for key, or an error if it doesn't exist, is expired, or is revoked
+func (s *KeyStore) Authenticate(key string) (*APIKey, error) {
+	hash := hashKey(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	c, ok := s.cache[hash]
+	if ok && now.After(c.expires) {
+		delete(s.cache, hash)
+		ok = false
+	}
+	s.mu.Unlock()
+
+	var k *APIKey
+	if ok {
+		k = c.key
+	} else {
+		var err error
+		if k, err = s.db.getAPIKey(hash); err != nil {
+			return nil, err
+		}
+		if k == nil {
+			return nil, ErrInvalidAPIKey
+		}
+		s.mu.Lock()
+		s.cache[hash] = &cachedKey{key: k, expires: now.Add(s.ttl)}
+		s.mu.Unlock()
+	}
+
+	if k.Revoked {
+		return nil, ErrRevokedAPIKey
+	}
+	if k.Expired(now) {
+		return nil, ErrExpiredAPIKey
+	}
+	return k, nil
+}
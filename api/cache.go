@@ -1,58 +1,132 @@
 package api
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
 
-//Cache is a cache id lookup by MD5 hash
+// CacheStats are counters for cache lookups
+type CacheStats struct {
+	Size      int   `json:"size"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+type cacheEntry struct {
+	hash Hash
+	id   int
+}
+
+// Cache is a cache id lookup by MD5 hash.
+// If the cache has a capacity, the least recently used entry is evicted when it's full
 type Cache struct {
-	store map[Hash]int
-	mu    *sync.RWMutex
+	hits      int64
+	misses    int64
+	evictions int64
+
+	capacity int
+	store    map[Hash]*list.Element
+	order    *list.List
+	mu       *sync.Mutex
 }
 
-//Add adds an entry to the cache
+// Add adds an entry to the cache
 func (c *Cache) Add(h Hash, id int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.store[h] = id
+	if el, ok := c.store[h]; ok {
+		el.Value.(*cacheEntry).id = id
+		c.order.MoveToFront(el)
+		return
+	}
+	c.store[h] = c.order.PushFront(&cacheEntry{hash: h, id: id})
+	if c.capacity > 0 && c.order.Len() > c.capacity {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.store, el.Value.(*cacheEntry).hash)
+		atomic.AddInt64(&(c.evictions), 1)
+	}
 }
 
-//Delete removes an entry from the cache
+// Delete removes an entry from the cache
 func (c *Cache) Delete(h Hash) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.store, h)
+	if el, ok := c.store[h]; ok {
+		c.order.Remove(el)
+		delete(c.store, h)
+	}
 }
 
-//Get returns an id by hash. If the entry doesn't exist, 0 is returned
+// Get returns an id by hash. If the entry doesn't exist, 0 is returned
 func (c *Cache) Get(h Hash) int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	id := c.store[h]
-	return id
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.store[h]
+	if !ok {
+		atomic.AddInt64(&(c.misses), 1)
+		return 0
+	}
+	atomic.AddInt64(&(c.hits), 1)
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).id
 }
 
-//Visit calls fn(key, val) for each entry in the cache.
-//fn should not attempt any modifications to key or val, and should not call any methods on c
+// Visit calls fn(key, val) for each entry in the cache, from least to most recently used.
+// fn should not attempt any modifications to key or val, and should not call any methods on c
 func (c *Cache) Visit(fn func(key Hash, val int)) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	for key, val := range c.store {
-		fn(key, val)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+		fn(e.hash, e.id)
 	}
 }
 
-//Clear removes all entries from th  cache
+// Clear removes all entries from the cache
 func (c *Cache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for i := range c.store {
-		delete(c.store, i)
+	c.store = make(map[Hash]*list.Element)
+	c.order.Init()
+}
+
+// Len returns the number of entries in the cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns a snapshot of the cache's counters
+func (c *Cache) Stats() *CacheStats {
+	return &CacheStats{
+		Size:      c.Len(),
+		Capacity:  c.capacity,
+		Hits:      atomic.LoadInt64(&(c.hits)),
+		Misses:    atomic.LoadInt64(&(c.misses)),
+		Evictions: atomic.LoadInt64(&(c.evictions)),
 	}
 }
 
-//NewCache returns a new initialized cache
+// NewCache returns a new initialized cache with no capacity limit
 func NewCache() *Cache {
+	return NewLRUCache(0)
+}
+
+// NewLRUCache returns a new initialized cache that holds at most capacity entries.
+// If capacity <= 0, the cache is unbounded
+func NewLRUCache(capacity int) *Cache {
+	if capacity < 0 {
+		capacity = 0
+	}
 	return &Cache{
-		store: make(map[Hash]int),
-		mu:    new(sync.RWMutex),
+		capacity: capacity,
+		store:    make(map[Hash]*list.Element),
+		order:    list.New(),
+		mu:       new(sync.Mutex),
 	}
 }
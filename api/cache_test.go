@@ -0,0 +1,50 @@
+package api
+
+import "testing"
+
+func TestCacheLRU(t *testing.T) {
+	c := NewLRUCache(2)
+	a, b, d := NewHash("a"), NewHash("b"), NewHash("d")
+
+	c.Add(a, 1)
+	c.Add(b, 2)
+	if id := c.Get(a); id != 1 {
+		t.Errorf("expected 1, got %d", id)
+	}
+
+	//b is now the least recently used
+	c.Add(d, 3)
+	if id := c.Get(b); id != 0 {
+		t.Errorf("expected b to be evicted, got %d", id)
+	}
+	if id := c.Get(a); id != 1 {
+		t.Errorf("expected 1, got %d", id)
+	}
+	if id := c.Get(d); id != 3 {
+		t.Errorf("expected 3, got %d", id)
+	}
+
+	s := c.Stats()
+	if s.Size != 2 || s.Capacity != 2 || s.Hits != 3 || s.Misses != 1 || s.Evictions != 1 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+
+	var visited []int
+	c.Visit(func(_ Hash, val int) { visited = append(visited, val) })
+	if len(visited) != 2 || visited[0] != 1 || visited[1] != 3 {
+		t.Errorf("expected to visit [1 3], got %v", visited)
+	}
+}
+
+func TestCacheUnbounded(t *testing.T) {
+	c := NewCache()
+	for i := 0; i < 1000; i++ {
+		c.Add(NewHash(string(rune(i))), i+1)
+	}
+	if n := c.Len(); n != 1000 {
+		t.Errorf("expected 1000 entries, got %d", n)
+	}
+	if e := c.Stats().Evictions; e != 0 {
+		t.Errorf("expected no evictions, got %d", e)
+	}
+}
@@ -1,11 +1,52 @@
 package api
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 // Context is a set of services accessed by endpoints
 type Context struct {
-	DB     *DB
+	DB *DB
+
+	// Keys authenticates API keys; if nil, only APIKey is accepted
+	Keys *KeyStore
+
+	// APIKey, if not empty, is a key with the query and export scopes that isn't stored in the database
 	APIKey string
+
+	// AnonymousScopes are the scopes allowed for requests without an API key
+	AnonymousScopes []Scope
+
+	// Tokens looks up the device tokens sent by submit requests
+	Tokens *TokenStore
+
+	// TokenMode is what's done with submitted entries without a valid device token for their serial; default: TokenModeOff
+	TokenMode TokenMode
+
+	// Signatures, if not nil, verifies the signatures of submit requests
+	Signatures *Verifier
+
+	// SignatureMode is what's done with unsigned submit requests if Signatures isn't nil; default: SignatureModeAccept
+	SignatureMode SignatureMode
+
+	// ClientCerts records the subject of each submit request's verified client certificate on its entries as ClientCertAttribute
+	ClientCerts bool
+
+	// Normalizer, if not nil, is applied to submitted entries before they're validated
+	Normalizer *Normalizer
+
+	// MaxClockSkew is how far in the future a batch submitted entry's time can be; disabled if <= 0
+	MaxClockSkew time.Duration
+
+	// MaxBackdate is how far in the past a batch submitted entry's time can be; disabled if <= 0
+	MaxBackdate time.Duration
+
+	// Exclude is the accounts skipped by last user queries unless overridden by the request; default: DefaultExclusion
+	Exclude *Exclusion
+
+	// LookupTolerance is the default window before and after the queried time searched by IP lookups; default: 1h
+	LookupTolerance time.Duration
 }
 
 type contextHandler struct {
@@ -2,10 +2,16 @@ package api
 
 import (
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,12 +22,15 @@ func (c *counter) Next() int64 {
 	return int64(*c)
 }
 
+var numberedPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
 func logQueryError(stmt *sql.Stmt, args ...interface{}) {
 	if stmt == nil {
 		log.Println("nil sql.Stmt passed to logQueryError with args:", args)
 	}
 	query := reflect.ValueOf(stmt).Elem().FieldByName("query").String()
-	log.Println("Error: Offending query:", fmt.Sprintf(strings.Replace(query, "?", "\"%v\"", -1), args...))
+	query = numberedPlaceholder.ReplaceAllString(strings.Replace(query, "?", "\"%v\"", -1), "\"%[$1]v\"")
+	log.Println("Error: Offending query:", fmt.Sprintf(query, args...))
 }
 
 // Insert represents a Decomposed Entry. If a field of Insert is nil, it already is in the database
@@ -30,23 +39,79 @@ type Insert struct {
 	*Device
 	*Address
 	*Identity
+	*Platform
+	*AttributeSet
 	*LogEntry
 
 	UserHash     Hash
 	DeviceHash   Hash
 	AddressHash  Hash
 	IdentityHash Hash
+	PlatformHash Hash
+
+	AttributeSetHash Hash
 
 	UserID     int
 	DeviceID   int
 	AddressID  int
 	IdentityID int
+	PlatformID int
+
+	AttributeSetID int
+
+	entry    *Entry
+	attempts int
+	err      error
+	spooled  spoolRef
+}
+
+// Stats are counters for the outcomes of queued entries
+type Stats struct {
+	Written       int64 `json:"written"`
+	Retried       int64 `json:"retried"`
+	DeadLettered  int64 `json:"dead_lettered"`
+	FailedBatches int64 `json:"failed_batches"`
+
+	Cache *CacheStats `json:"cache"`
+}
+
+// Options configures a DB
+type Options struct {
+	// Workers is the number of worker goroutines; default: 10
+	Workers int
+
+	// WriteInterval is how often queued entries are written to the database; default: 15s
+	WriteInterval time.Duration
+
+	// Spool, if not nil, is used to store entries on disk until they're committed.
+	// Any entries already in it are replayed, and the DB takes ownership of it, closing it when the DB is closed
+	Spool *Spool
+
+	// MaxAttempts is the number of times an entry that fails with a retryable error is tried before it's dead-lettered; default: 5.
+	// A failed transaction counts as an attempt for every entry in it
+	MaxAttempts int
+
+	// BatchSize is the maximum number of log entries written with a single INSERT; default: the most allowed by the driver.
+	// A BatchSize of 1 writes each log entry with its own INSERT
+	BatchSize int
+
+	// CacheSize is the maximum number of user, device, address, and identity IDs kept in memory; default: 100000
+	CacheSize int
+
+	// CacheWarmup, if not 0, preloads the cache with the identities that logged entries within CacheWarmup of startup
+	CacheWarmup time.Duration
+
+	// SessionGap, if not 0, is the longest time between an identity's check-ins that are part of the same session.
+	// Written log entries are merged into the session table in the same transaction
+	SessionGap time.Duration
 }
 
 // DB represents a database
 type DB struct {
 	DB *sql.DB
 
+	dialect *dialect
+
 	entries chan *Entry
 	inserts chan *Insert
 
@@ -54,14 +119,107 @@ type DB struct {
 
 	cache *Cache
 
+	spool *Spool
+
+	maxAttempts int
+	batchSize   int
+	sessionGap  time.Duration
+	stats       *Stats
+
+	mu         *sync.RWMutex
+	closed     bool
+	stop       chan struct{}
+	stopOnce   *sync.Once
+	feederWG   *sync.WaitGroup
+	workerWG   *sync.WaitGroup
+	writerDone chan error
+
 	err error
 
 	WriteInterval time.Duration
 }
 
-// Push passes the entry onto the queue to be processed
-func (db *DB) Push(e *Entry) {
-	db.entries <- e
+// ErrClosed is returned by Push after the DB is closed
+var ErrClosed = errors.New("db closed")
+
+// Push passes the entry onto the queue to be processed.
+// If db has a Spool, the entry is written to it and Push returns without waiting for the queue
+func (db *DB) Push(e *Entry) error {
+	_, err := db.PushBatch([]*Entry{e})
+	return err
+}
+
+// PushBatch passes entries onto the queue to be processed, returning the number of entries queued before an error occurred.
+// If db has a Spool, the entries are written to it together, so either all of them are queued or none are
+func (db *DB) PushBatch(entries []*Entry) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	if db.spool != nil {
+		if err := db.spool.Append(entries...); err != nil {
+			return 0, err
+		}
+		return len(entries), nil
+	}
+	for idx, e := range entries {
+		select {
+		case db.entries <- e:
+		case <-db.stop:
+			return idx, ErrClosed
+		}
+	}
+	return len(entries), nil
+}
+
+// minFeederBackoff and maxFeederBackoff bound how long feeder waits before reading the spool again after an error
+const (
+	minFeederBackoff = 100 * time.Millisecond
+	maxFeederBackoff = time.Minute
+)
+
+// feeder reads entries from the spool and passes them onto the queue until the spool is stopped.
+// If reading fails, it's retried with exponential backoff
+func (db *DB) feeder() {
+	defer db.feederWG.Done()
+	backoff := minFeederBackoff
+	for {
+		e, err := db.spool.Next()
+		if err == ErrSpoolClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading spool; retrying in %v: %v\n", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-db.stop:
+				return
+			}
+			if backoff *= 2; backoff > maxFeederBackoff {
+				backoff = maxFeederBackoff
+			}
+			continue
+		}
+		backoff = minFeederBackoff
+		db.entries <- e
+	}
+}
+
+// Stats returns a snapshot of db's counters
+func (db *DB) Stats() *Stats {
+	return &Stats{
+		Written:       atomic.LoadInt64(&(db.stats.Written)),
+		Retried:       atomic.LoadInt64(&(db.stats.Retried)),
+		DeadLettered:  atomic.LoadInt64(&(db.stats.DeadLettered)),
+		FailedBatches: atomic.LoadInt64(&(db.stats.FailedBatches)),
+
+		Cache: db.cache.Stats(),
+	}
 }
 
 // QueueLen returns then length of the writer queue
@@ -69,10 +227,10 @@ func (db *DB) QueueLen() int {
 	return len(db.queue)
 }
 
-// worker processes entries from the queue and pushes them to the writer
+// worker processes entries from the queue and pushes them to the writer until db.entries is closed
 func (db *DB) worker() {
-	for {
-		e := <-db.entries
+	defer db.workerWG.Done()
+	for e := range db.entries {
 		uH, dH, aH, iH := e.Hashes()
 
 		var uID, dID, aID, iID int
@@ -97,10 +255,18 @@ func (db *DB) worker() {
 		}
 		var a *Address
 		if aID = db.cache.Get(aH); aID == 0 {
+			ip, err := parseIP(e.IP)
+			if err != nil {
+				log.Println("Error parsing IP:", err)
+			}
+			internetIP, err := parseIP(e.InternetIP)
+			if err != nil {
+				log.Println("Error parsing Internet IP:", err)
+			}
 			a = &Address{
 				ID:         aID,
-				IP:         e.IP,
-				InternetIP: e.InternetIP,
+				IP:         ip,
+				InternetIP: internetIP,
 			}
 		}
 		var i *Identity
@@ -113,33 +279,84 @@ func (db *DB) worker() {
 			}
 		}
 
+		var (
+			p   *Platform
+			pID int
+		)
+		pH, hasPlatform := e.PlatformHash()
+		if hasPlatform {
+			if pID = db.cache.Get(pH); pID == 0 {
+				p = &Platform{
+					OSVersion:     e.OSVersion,
+					OSBuild:       e.OSBuild,
+					Model:         e.Model,
+					ClientVersion: e.ClientVersion,
+					MACAddresses:  e.macAddresses(),
+				}
+			}
+		}
+
+		var (
+			as   *AttributeSet
+			asID int
+		)
+		asH, hasAttributes := e.AttributesHash()
+		if hasAttributes {
+			if asID = db.cache.Get(asH); asID == 0 {
+				as = &AttributeSet{Hash: asH}
+				for _, key := range e.attributeKeys() {
+					h := attributeHash(key, e.Attributes[key])
+					as.Attributes = append(as.Attributes, &Attribute{
+						ID:    db.cache.Get(h),
+						Name:  key,
+						Value: e.Attributes[key],
+						Hash:  h,
+					})
+				}
+			}
+		}
+
 		ins := &Insert{
-			User:     u,
-			Device:   d,
-			Address:  a,
-			Identity: i,
+			User:         u,
+			Device:       d,
+			Address:      a,
+			Identity:     i,
+			Platform:     p,
+			AttributeSet: as,
 
 			LogEntry: &LogEntry{
-				IdentityID: iID,
-				Time:       e.Time,
+				IdentityID:     iID,
+				PlatformID:     pID,
+				AttributeSetID: asID,
+				Time:           e.Time,
 			},
 
 			UserHash:     uH,
 			DeviceHash:   dH,
 			AddressHash:  aH,
 			IdentityHash: iH,
+			PlatformHash: pH,
+
+			AttributeSetHash: asH,
 
 			UserID:     uID,
 			DeviceID:   dID,
 			AddressID:  aID,
 			IdentityID: iID,
+			PlatformID: pID,
+
+			AttributeSetID: asID,
+
+			entry:   e,
+			spooled: e.spooled,
 		}
 
 		db.inserts <- ins
 	}
 }
 
-// makeStmt creates a prepared statement or sets an error on db if one occurred
+// makeStmt creates a prepared statement or sets an error on db if one occurred.
+// query should already be rebound to db's dialect
 func makeStmt(db *DB, query string) *sql.Stmt {
 	s, err := db.DB.Prepare(query)
 	if err != nil {
@@ -150,7 +367,7 @@ func makeStmt(db *DB, query string) *sql.Stmt {
 }
 
 // getOrInsert gets the id of a row if it exists or creates the row and returns the new id
-func getOrInsert(getStmt, insStmt *sql.Stmt, args ...interface{}) (id int, err error) {
+func getOrInsert(d *dialect, getStmt, insStmt *sql.Stmt, args ...interface{}) (id int, err error) {
 	rID := new(int)
 
 	row := getStmt.QueryRow(args...)
@@ -163,249 +380,791 @@ func getOrInsert(getStmt, insStmt *sql.Stmt, args ...interface{}) (id int, err e
 		return *rID, nil
 	}
 
-	res, err := insStmt.Exec(args...)
+	i, err := d.insertID(insStmt, args...)
 	if err != nil {
 		logQueryError(insStmt, args...)
-		return 0, err
 	}
+	return i, err
+}
 
-	i, err := res.LastInsertId()
-	if err != nil {
-		logQueryError(insStmt, args...)
+// prepareStmts creates the writer's prepared statements.
+// If there is a problem getting to the database, it waits and tries again until db is closed, then returns nil
+func (db *DB) prepareStmts() map[string]*sql.Stmt {
+	dia := db.dialect
+	for {
+		stmts := map[string]*sql.Stmt{
+
+			"uIns": makeStmt(db, dia.insert(`INSERT INTO "user"(uid, username, fullname) VALUES(?, ?, ?)`)),
+			"uGet": makeStmt(db, dia.rebind(`SELECT id FROM "user" WHERE uid=? AND username=? AND fullname=?;`)),
+
+			"dIns": makeStmt(db, dia.insert(`INSERT INTO device(serial, clientidentifier, hostname) VALUES(?, ?, ?)`)),
+			"dGet": makeStmt(db, dia.rebind(`SELECT id FROM device WHERE serial=? AND clientidentifier=? AND hostname=?;`)),
+
+			"aIns": makeStmt(db, dia.insert(`INSERT INTO address(ip, internetip) VALUES(?, ?)`)),
+			"aGet": makeStmt(db, dia.rebind(`SELECT id FROM address WHERE ip=? AND internetip=?;`)),
+
+			"iIns": makeStmt(db, dia.insert(`INSERT INTO identity(user_id, device_id, address_id) VALUES(?, ?, ?)`)),
+			"iGet": makeStmt(db, dia.rebind(`SELECT id FROM identity where user_id=? AND device_id=? AND address_id=?;`)),
+
+			"lIns": makeStmt(db, dia.rebind(`INSERT INTO log(identity_id, platform_id, attribute_set_id, time) VALUES(?, ?, ?, ?);`)),
+
+			"pIns": makeStmt(db, dia.insert(`INSERT INTO platform(os_version, os_build, model, client_version, mac_addresses) VALUES(?, ?, ?, ?, ?)`)),
+			"pGet": makeStmt(db, dia.rebind(`SELECT id FROM platform WHERE os_version=? AND os_build=? AND model=? AND client_version=? AND mac_addresses=?;`)),
+
+			"atIns": makeStmt(db, dia.insert(`INSERT INTO attribute(name, value) VALUES(?, ?)`)),
+			"atGet": makeStmt(db, dia.rebind(`SELECT id FROM attribute WHERE name=? AND value=?;`)),
+
+			"asIns": makeStmt(db, dia.insert(`INSERT INTO attribute_set(hash) VALUES(?)`)),
+			"asGet": makeStmt(db, dia.rebind(`SELECT id FROM attribute_set WHERE hash=?;`)),
+			"amIns": makeStmt(db, dia.rebind(`INSERT INTO attribute_set_member(attribute_set_id, attribute_id) VALUES(?, ?);`)),
+		}
+
+		if db.err == nil {
+			return stmts
+		}
+		db.err = nil
+		closeStmts(stmts)
+
+		select {
+		case <-time.After(db.WriteInterval):
+		case <-db.stop:
+			return nil
+		}
 	}
-	return int(i), err
 }
 
-// write polls the queue and every db.WriteInterval writes the data to the database and updates the cache
-func (db *DB) writer() {
-	var ins *Insert
+// closeStmts closes all non-nil statements in stmts
+func closeStmts(stmts map[string]*sql.Stmt) {
+	for _, v := range stmts {
+		if v == nil {
+			continue
+		}
+		if err := v.Close(); err != nil {
+			log.Println("Error closing statement:", err)
+		}
+	}
+}
 
-	c := new(counter)
+// unresolved returns true if any of ins's IDs weren't cached and must be resolved
+func (ins *Insert) unresolved() bool {
+	return ins.User != nil || ins.Device != nil || ins.Address != nil || ins.Identity != nil || ins.Platform != nil || ins.AttributeSet != nil
+}
 
-	lCache := NewCache()
+// resolveIDs gets or inserts the user, device, address, and identity for ins, adding any new IDs to lCache
+func (db *DB) resolveIDs(tstmts map[string]*sql.Stmt, lCache *Cache, ins *Insert) error {
+	dia := db.dialect
+	var err error
 
-mkstmts:
-	stmts := map[string]*sql.Stmt{
+	//get or insert and get IDs
+	if u := ins.User; u != nil {
+		ins.UserID, err = getOrInsert(dia, tstmts["uGet"], tstmts["uIns"], u.UID, u.Username, u.FullName)
+		if err != nil {
+			return fmt.Errorf("could not get or insert user: %w", err)
+		}
+		lCache.Add(ins.UserHash, ins.UserID)
+	}
 
-		"uIns": makeStmt(db, "INSERT INTO user(uid, username, fullname) VALUES(?, ?, ?);"),
-		"uGet": makeStmt(db, "SELECT id FROM user WHERE uid=? AND username=? AND fullname=?;"),
+	if d := ins.Device; d != nil {
+		ins.DeviceID, err = getOrInsert(dia, tstmts["dGet"], tstmts["dIns"], d.Serial, d.ClientIdentifier, d.Hostname)
+		if err != nil {
+			return fmt.Errorf("could not get or insert device: %w", err)
+		}
+		lCache.Add(ins.DeviceHash, ins.DeviceID)
+	}
 
-		"dIns": makeStmt(db, "INSERT INTO device(serial, clientidentifier, hostname) VALUES(?, ?, ?);"),
-		"dGet": makeStmt(db, "SELECT id FROM device WHERE serial=? AND clientidentifier=? AND hostname=?;"),
+	if a := ins.Address; a != nil {
+		ins.AddressID, err = getOrInsert(dia, tstmts["aGet"], tstmts["aIns"], ipBytes(a.IP), ipBytes(a.InternetIP))
+		if err != nil {
+			return fmt.Errorf("could not get or insert address: %w", err)
+		}
+		lCache.Add(ins.AddressHash, ins.AddressID)
+	}
 
-		"aIns": makeStmt(db, "INSERT INTO address(ip, internetip) VALUES(?, ?);"),
-		"aGet": makeStmt(db, "SELECT id FROM address WHERE ip=? AND internetip=?;"),
+	if i := ins.Identity; i != nil {
+		ins.IdentityID, err = getOrInsert(dia, tstmts["iGet"], tstmts["iIns"], ins.UserID, ins.DeviceID, ins.AddressID)
+		if err != nil {
+			return fmt.Errorf("could not get or insert identity: %w", err)
+		}
+		lCache.Add(ins.IdentityHash, ins.IdentityID)
+	}
 
-		"iIns": makeStmt(db, "INSERT INTO identity(user_id, device_id, address_id) VALUES(?, ?, ?);"),
-		"iGet": makeStmt(db, "SELECT id FROM identity where user_id=? AND device_id=? AND address_id=?;"),
+	if p := ins.Platform; p != nil {
+		ins.PlatformID, err = getOrInsert(dia, tstmts["pGet"], tstmts["pIns"], p.OSVersion, p.OSBuild, p.Model, p.ClientVersion, p.MACAddresses)
+		if err != nil {
+			return fmt.Errorf("could not get or insert platform: %w", err)
+		}
+		lCache.Add(ins.PlatformHash, ins.PlatformID)
+	}
 
-		"lIns": makeStmt(db, "INSERT INTO log(identity_id, time) VALUES(?, ?);"),
+	if as := ins.AttributeSet; as != nil {
+		ins.AttributeSetID, err = getOrInsertAttributeSet(dia, tstmts, lCache, as)
+		if err != nil {
+			return fmt.Errorf("could not get or insert attribute set: %w", err)
+		}
+		lCache.Add(ins.AttributeSetHash, ins.AttributeSetID)
 	}
 
-	//if there is a problem getting to the database wait and try again
-	if db.err != nil {
-		db.err = nil
-		time.Sleep(db.WriteInterval)
-		goto mkstmts
+	return nil
+}
+
+// getOrInsertAttributeSet gets the id of an attribute set if it exists,
+// or creates the set and any of its attributes that don't exist and returns the new id
+func getOrInsertAttributeSet(d *dialect, tstmts map[string]*sql.Stmt, lCache *Cache, as *AttributeSet) (int, error) {
+	hash := hex.EncodeToString(as.Hash[:])
+
+	var id int
+	err := tstmts["asGet"].QueryRow(hash).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		logQueryError(tstmts["asGet"], hash)
+		return 0, err
 	}
 
-	timer := time.NewTimer(db.WriteInterval)
+	//attribute IDs aren't stored on as, since they're rolled back if a later statement fails
+	ids := make([]int, len(as.Attributes))
+	for idx, a := range as.Attributes {
+		if ids[idx] = a.ID; ids[idx] != 0 {
+			continue
+		}
+		if ids[idx], err = getOrInsert(d, tstmts["atGet"], tstmts["atIns"], a.Name, a.Value); err != nil {
+			return 0, fmt.Errorf("could not get or insert attribute: %w", err)
+		}
+		lCache.Add(a.Hash, ids[idx])
+	}
 
-	for {
+	if id, err = d.insertID(tstmts["asIns"], hash); err != nil {
+		logQueryError(tstmts["asIns"], hash)
+		return 0, err
+	}
+	for _, aID := range ids {
+		if _, err = tstmts["amIns"].Exec(id, aID); err != nil {
+			logQueryError(tstmts["amIns"], id, aID)
+			return 0, err
+		}
+	}
 
-		select {
-		case ins = <-db.inserts:
-			db.queue[c.Next()] = ins
-		case <-timer.C:
-			timer.Reset(db.WriteInterval)
+	return id, nil
+}
 
-			if len(db.queue) == 0 {
-				continue
-			}
+// logArgs returns the values of ins's log entry columns.
+// Times are stored in UTC so they compare correctly in every database
+func (ins *Insert) logArgs() []interface{} {
+	var platformID, attributeSetID interface{}
+	if ins.PlatformID != 0 {
+		platformID = ins.PlatformID
+	}
+	if ins.AttributeSetID != 0 {
+		attributeSetID = ins.AttributeSetID
+	}
+	return []interface{}{ins.IdentityID, platformID, attributeSetID, ins.LogEntry.Time.UTC()}
+}
 
-			log.Println("Inserting", len(db.queue), "entries")
+// logColumns is the number of columns written for each log entry
+const logColumns = 4
 
-			//start transaction
-			tx, err := db.DB.Begin()
-			if err != nil {
-				log.Println("Error starting transaction:", err)
-				continue
-			}
+// insertLogQuery returns a multi-row INSERT statement for rows log entries
+func (db *DB) insertLogQuery(rows int) string {
+	var b strings.Builder
+	b.WriteString("INSERT INTO log(identity_id, platform_id, attribute_set_id, time) VALUES")
+	for i := 0; i < rows; i++ {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString("(?, ?, ?, ?)")
+	}
+	return db.dialect.rebind(b.String())
+}
+
+// insertLogs inserts the log entries for inses with a single statement
+func (db *DB) insertLogs(tx *sql.Tx, inses []*Insert) error {
+	args := make([]interface{}, 0, len(inses)*logColumns)
+	for _, ins := range inses {
+		args = append(args, ins.logArgs()...)
+	}
+	if _, err := tx.Exec(db.insertLogQuery(len(inses)), args...); err != nil {
+		return fmt.Errorf("could not insert logs: %w", err)
+	}
+	return nil
+}
 
-			//make transaction version of stmt
-			tstmts := make(map[string]*sql.Stmt)
-			for k, v := range stmts {
-				tstmts[k] = tx.Stmt(v)
+// deadLetter writes ins to the dead_letter table
+func (db *DB) deadLetter(tx *sql.Tx, ins *Insert, cause error) error {
+	buf, err := json.Marshal(ins.entry)
+	if err != nil {
+		return fmt.Errorf("could not encode entry: %w", err)
+	}
+	if _, err = tx.Exec(db.dialect.rebind("INSERT INTO dead_letter(time, entry, error, attempts) VALUES(?, ?, ?, ?)"),
+		time.Now().UTC(), string(buf), cause.Error(), ins.attempts); err != nil {
+		return fmt.Errorf("could not insert dead letter: %w", err)
+	}
+	return nil
+}
+
+// savepoint runs fn inside a savepoint, rolling back to the savepoint if fn returns an error.
+// fnErr is the error returned by fn; err is only set if the savepoint itself fails
+func savepoint(tx *sql.Tx, fn func() error) (fnErr, err error) {
+	if _, err = tx.Exec("SAVEPOINT entry"); err != nil {
+		return nil, fmt.Errorf("could not create savepoint: %w", err)
+	}
+	if fnErr = fn(); fnErr != nil {
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT entry"); err != nil {
+			return fnErr, fmt.Errorf("could not roll back savepoint: %w", err)
+		}
+	}
+	if _, err = tx.Exec("RELEASE SAVEPOINT entry"); err != nil {
+		return fnErr, fmt.Errorf("could not release savepoint: %w", err)
+	}
+	return fnErr, nil
+}
+
+// flush writes the queue to the database in a single transaction and updates the cache.
+// IDs that aren't cached are resolved for all entries inside one savepoint. If that fails,
+// each entry's IDs are resolved inside its own savepoint so a failed entry doesn't affect the others.
+// Then log entries are written with multi-row INSERTs of up to db.batchSize rows.
+// If sessions are enabled, each INSERT's entries are merged into the session table in the same savepoint.
+// If a multi-row INSERT or its session merge fails, its rows are written one at a time.
+// Entries that fail with a permanent error, or a retryable error MaxAttempts times, are moved to the dead_letter table.
+// If the transaction itself fails, it counts as a failed attempt for every entry in it,
+// and entries that are out of attempts are moved to the dead_letter table at the start of the next flush.
+// Committed and dead-lettered entries are removed from the queue; an error is only returned if the transaction fails
+func (db *DB) flush(stmts map[string]*sql.Stmt, lCache *Cache) error {
+	log.Println("Inserting", len(db.queue), "entries")
+
+	//start transaction
+	tx, err := db.DB.Begin()
+	if err != nil {
+		atomic.AddInt64(&(db.stats.FailedBatches), 1)
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	//make transaction version of stmt
+	tstmts := make(map[string]*sql.Stmt)
+	for k, v := range stmts {
+		tstmts[k] = tx.Stmt(v)
+	}
+	defer closeStmts(tstmts)
+
+	var (
+		written, dead, retried []int64
+		pending, resolved      []int64
+		caches                 = make(map[int64]*Cache)
+		failed                 = make(map[int64]bool)
+	)
+
+	//abort records a failed attempt for every entry that hasn't already failed in this flush, since the transaction failed with tErr
+	abort := func(tErr error) error {
+		atomic.AddInt64(&(db.stats.FailedBatches), 1)
+		for key, ins := range db.queue {
+			if !failed[key] {
+				ins.attempts++
+				ins.err = tErr
 			}
+		}
+		return tErr
+	}
 
-			//loop over queue
-			for _, ins := range db.queue {
+	//bury moves the entry at key to the dead_letter table. If the dead letter can't be written, the entry is kept for the next flush.
+	//An error is only returned if the savepoint fails
+	bury := func(key int64, cause error) error {
+		ins := db.queue[key]
+		log.Printf("Error writing entry (attempt %d); moving to dead letter: %v\n", ins.attempts, cause)
+		//a failed insert would abort the whole transaction in some databases, so it's isolated like any other entry
+		dErr, err := savepoint(tx, func() error { return db.deadLetter(tx, ins, cause) })
+		if err != nil {
+			return err
+		}
+		if dErr != nil {
+			log.Println("Error writing dead letter; retrying:", dErr)
+			retried = append(retried, key)
+			return nil
+		}
+		dead = append(dead, key)
+		return nil
+	}
 
-				//get or insert and get IDs
-				if u := ins.User; u != nil {
-					ins.UserID, err = getOrInsert(tstmts["uGet"], tstmts["uIns"], u.UID, u.Username, u.FullName)
-					if err != nil {
-						log.Println("Error getting or inserting user:", err)
-						continue
-					}
-					lCache.Add(ins.UserHash, ins.UserID)
-				}
+	//fail records a failed attempt for the entry at key, moving it to the dead_letter table if it can't be retried
+	fail := func(key int64, iErr error) error {
+		ins := db.queue[key]
+		ins.attempts++
+		ins.err = iErr
+		failed[key] = true
+		if !db.dialect.permanent(iErr) && ins.attempts < db.maxAttempts {
+			log.Printf("Error writing entry (attempt %d of %d): %v\n", ins.attempts, db.maxAttempts, iErr)
+			retried = append(retried, key)
+			return nil
+		}
+		return bury(key, iErr)
+	}
 
-				if d := ins.Device; d != nil {
-					ins.DeviceID, err = getOrInsert(tstmts["dGet"], tstmts["dIns"], d.Serial, d.ClientIdentifier, d.Hostname)
-					if err != nil {
-						log.Println("Error getting or inserting device:", err)
-						continue
-					}
-					lCache.Add(ins.DeviceHash, ins.DeviceID)
-				}
+	//dead-letter entries that ran out of attempts in earlier flushes
+	for key, ins := range db.queue {
+		if ins.attempts < db.maxAttempts {
+			pending = append(pending, key)
+			continue
+		}
+		failed[key] = true
+		if err = bury(key, ins.err); err != nil {
+			return abort(err)
+		}
+	}
 
-				if a := ins.Address; a != nil {
-					ins.AddressID, err = getOrInsert(tstmts["aGet"], tstmts["aIns"], a.IP, a.InternetIP)
-					if err != nil {
-						log.Println("Error getting or inserting address:", err)
-						continue
-					}
-					lCache.Add(ins.AddressHash, ins.AddressID)
+	//resolve IDs of entries that weren't all cached
+	var unresolved []int64
+	for _, key := range pending {
+		if db.queue[key].unresolved() {
+			unresolved = append(unresolved, key)
+			continue
+		}
+		resolved = append(resolved, key)
+	}
+	if len(unresolved) != 0 {
+		bErr, err := savepoint(tx, func() error {
+			for _, key := range unresolved {
+				caches[key] = NewCache()
+				if err := db.resolveIDs(tstmts, caches[key], db.queue[key]); err != nil {
+					return err
 				}
-
-				if i := ins.Identity; i != nil {
-					ins.IdentityID, err = getOrInsert(tstmts["iGet"], tstmts["iIns"], ins.UserID, ins.DeviceID, ins.AddressID)
-					if err != nil {
-						log.Println("Error getting or inserting identity:", err)
-						continue
+			}
+			return nil
+		})
+		if err != nil {
+			return abort(err)
+		}
+		if bErr == nil {
+			resolved = append(resolved, unresolved...)
+		} else {
+			//fall back to resolving entries one at a time to find the failed entries
+			log.Println("Error resolving IDs; retrying individually:", bErr)
+			for _, key := range unresolved {
+				ins := db.queue[key]
+				eCache := NewCache()
+				iErr, err := savepoint(tx, func() error { return db.resolveIDs(tstmts, eCache, ins) })
+				if err != nil {
+					return abort(err)
+				}
+				if iErr != nil {
+					delete(caches, key)
+					if err = fail(key, iErr); err != nil {
+						return abort(err)
 					}
-					lCache.Add(ins.IdentityHash, ins.IdentityID)
+					continue
 				}
+				resolved = append(resolved, key)
+				caches[key] = eCache
+			}
+		}
+	}
 
-				//insert LogEntry
-				_, err = tstmts["lIns"].Exec(
-					ins.IdentityID,
-					ins.LogEntry.Time,
-				)
-				if err != nil {
-					logQueryError(tstmts["lIns"], ins.IdentityID, ins.LogEntry.Time)
-					log.Println("Error inserting log:", err)
-				}
-			} //end inner loop
+	//writeLogs inserts the log entries for inses and merges them into sessions
+	writeLogs := func(inses []*Insert) error {
+		if len(inses) == 1 {
+			if _, err := tstmts["lIns"].Exec(inses[0].logArgs()...); err != nil {
+				logQueryError(tstmts["lIns"], inses[0].logArgs()...)
+				return fmt.Errorf("could not insert log: %w", err)
+			}
+		} else if err := db.insertLogs(tx, inses); err != nil {
+			return err
+		}
+		if db.sessionGap > 0 {
+			return db.updateSessions(tx, inses)
+		}
+		return nil
+	}
+
+	//insert log entries
+	for start := 0; start < len(resolved); start += db.batchSize {
+		end := start + db.batchSize
+		if end > len(resolved) {
+			end = len(resolved)
+		}
+		keys := resolved[start:end]
+
+		inses := make([]*Insert, len(keys))
+		for idx, key := range keys {
+			inses[idx] = db.queue[key]
+		}
+
+		bErr, err := savepoint(tx, func() error { return writeLogs(inses) })
+		if err != nil {
+			return abort(err)
+		}
+		if bErr == nil {
+			written = append(written, keys...)
+			continue
+		}
+		if len(keys) == 1 {
+			if err = fail(keys[0], bErr); err != nil {
+				return abort(err)
+			}
+			continue
+		}
 
-			//commit
-			err = tx.Commit()
+		//fall back to inserting rows one at a time to find the failed entries
+		log.Println("Error inserting logs; retrying individually:", bErr)
+		for idx, key := range keys {
+			iErr, err := savepoint(tx, func() error { return writeLogs(inses[idx : idx+1]) })
 			if err != nil {
-				log.Println("Error commiting db:", err)
+				return abort(err)
+			}
+			if iErr != nil {
+				if err = fail(key, iErr); err != nil {
+					return abort(err)
+				}
 				continue
 			}
+			written = append(written, key)
+		}
+	}
 
-			//clear queue
-			for i := range db.queue {
-				delete(db.queue, i)
-			}
+	//commit
+	if err = tx.Commit(); err != nil {
+		lCache.Clear()
+		return abort(fmt.Errorf("could not commit: %w", err))
+	}
 
-			//update db cache with entries then clear local cache
-			lCache.Visit(func(key Hash, val int) {
-				db.cache.Add(key, val)
+	atomic.AddInt64(&(db.stats.Written), int64(len(written)))
+	atomic.AddInt64(&(db.stats.DeadLettered), int64(len(dead)))
+	atomic.AddInt64(&(db.stats.Retried), int64(len(retried)))
+
+	//cache IDs of written entries
+	for _, key := range written {
+		if eCache, ok := caches[key]; ok {
+			eCache.Visit(func(key Hash, val int) {
+				lCache.Add(key, val)
 			})
-			lCache.Clear()
+		}
+	}
 
-			//close stmts
-			for _, v := range tstmts {
-				err = v.Close()
-				if err != nil {
-					log.Println("Error closing statement:", err)
-				}
+	//remove committed entries from queue and spool
+	committed := make([]spoolRef, 0, len(written)+len(dead))
+	for _, key := range append(written, dead...) {
+		committed = append(committed, db.queue[key].spooled)
+		delete(db.queue, key)
+	}
+	if db.spool != nil {
+		if err = db.spool.Ack(committed...); err != nil {
+			log.Println("Error updating spool:", err)
+		}
+		if err = db.spool.Rotate(); err != nil && err != ErrSpoolClosed {
+			log.Println("Error rotating spool:", err)
+		}
+	}
+
+	//update db cache with entries then clear local cache
+	lCache.Visit(func(key Hash, val int) {
+		db.cache.Add(key, val)
+	})
+	lCache.Clear()
+
+	return nil
+}
+
+// writer polls the queue and every db.WriteInterval writes the data to the database and updates the cache.
+// Once db.inserts is closed, the queue is written a final time and the result is sent on db.writerDone
+func (db *DB) writer() {
+	c := new(counter)
+
+	lCache := NewCache()
+
+	stmts := db.prepareStmts()
+
+	timer := time.NewTimer(db.WriteInterval)
+
+	for {
+
+		select {
+		case ins, ok := <-db.inserts:
+			if !ok {
+				timer.Stop()
+				db.writerDone <- db.finalFlush(stmts, lCache)
+				return
+			}
+			db.queue[c.Next()] = ins
+		case <-timer.C:
+			timer.Reset(db.WriteInterval)
+
+			if len(db.queue) == 0 || stmts == nil {
+				continue
+			}
+
+			if err := db.flush(stmts, lCache); err != nil {
+				log.Println("Error writing to db:", err)
 			}
 		}
 	}
 }
 
-const queryLastUser = `
-select 
-	user.username,
-	user.fullname,
-    device.serial,
-    address.ip,
-    address.internetip,
-	log.time
+// finalFlush writes any remaining entries and closes stmts. Entries that fail with a retryable error are tried again up to MaxAttempts.
+// An error is returned if any entries could not be written and aren't in the spool
+func (db *DB) finalFlush(stmts map[string]*sql.Stmt, lCache *Cache) error {
+	var err error
+	if stmts == nil {
+		err = errors.New("could not prepare statements")
+	} else {
+		for attempt := 0; attempt < db.maxAttempts && len(db.queue) != 0; attempt++ {
+			if err = db.flush(stmts, lCache); err != nil {
+				break
+			}
+		}
+		if err == nil && len(db.queue) != 0 {
+			err = errors.New("retryable errors")
+		}
+		closeStmts(stmts)
+	}
+
+	if len(db.queue) == 0 {
+		return nil
+	}
+	if db.spool != nil {
+		log.Println(len(db.queue), "entries could not be written and will be replayed from the spool")
+		return nil
+	}
+	return fmt.Errorf("%d entries lost: %w", len(db.queue), err)
+}
+
+const queryRecentIdentities = `
+select
+	"user".id,
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	device.id,
+	device.serial,
+	device.clientidentifier,
+	device.hostname,
+	address.id,
+	address.ip,
+	address.internetip,
+	identity.id
 from (
-    select
-        max(log.id) as id
-    from device
-    inner join identity on device.id = identity.device_id
-    inner join user on user.id = identity.user_id
-    inner join log on log.identity_id = identity.id
-    where
-        device.serial in (%s) and
-        user.username not in ('administrator', 'root', '')
-    group by
-        device.serial
-) as joined
-inner join log on
-    joined.id = log.id
+	select
+		identity_id,
+		max(id) as last_id
+	from log
+	where time >= ?
+	group by identity_id
+	order by last_id desc
+	limit ?
+) as recent
 inner join identity on
-    log.identity_id = identity.id
+	recent.identity_id = identity.id
+inner join "user" on
+	identity.user_id = "user".id
 inner join device on
-    identity.device_id = device.id
-inner join user on
-    identity.user_id = user.id
+	identity.device_id = device.id
 inner join address on
-    identity.address_id = address.id
+	identity.address_id = address.id
+order by recent.last_id
 `
 
-// QueryLastUser returns the last information for serials
-func (db *DB) QueryLastUser(serials []string) ([]*Entry, error) {
-	params := make([]interface{}, len(serials))
-	for idx, s := range serials {
-		params[idx] = s
+// warmCache adds the IDs of the identities that logged entries since since to the cache,
+// most recently active last, and returns the number of identities added.
+// At most a quarter of the cache's capacity is used, since each identity takes four entries
+func (db *DB) warmCache(since time.Time) (int, error) {
+	limit := db.cache.capacity / 4
+	if limit == 0 {
+		limit = 1
 	}
-	placeholder := strings.Join(strings.Split(strings.Repeat("?", len(serials)), ""), ",")
-	query := fmt.Sprintf(queryLastUser, placeholder)
 
-	rows, err := db.DB.Query(query, params...)
+	rows, err := db.DB.Query(db.dialect.rebind(queryRecentIdentities), since.UTC(), limit)
 	if err != nil {
-		return nil, fmt.Errorf("could not query db: %w", err)
+		return 0, fmt.Errorf("could not query db: %w", err)
 	}
 	defer rows.Close()
 
-	var entries []*Entry
+	var n int
 	for rows.Next() {
-		e := new(Entry)
-		if err := rows.Scan(&e.Username, &e.FullName, &e.Serial, &e.IP, &e.InternetIP, &e.Time); err != nil {
-			return nil, fmt.Errorf("could not scan row: %w", err)
+		var (
+			e                  = new(Entry)
+			ip, internetIP     []byte
+			uID, dID, aID, iID int
+		)
+		if err := rows.Scan(&uID, &e.UID, &e.Username, &e.FullName,
+			&dID, &e.Serial, &e.ClientIdentifier, &e.Hostname,
+			&aID, &ip, &internetIP, &iID); err != nil {
+			return n, fmt.Errorf("could not scan row: %w", err)
 		}
+		e.IP, e.InternetIP = ipString(ip), ipString(internetIP)
 
-		entries = append(entries, e)
+		uH, dH, aH, iH := e.Hashes()
+		db.cache.Add(uH, uID)
+		db.cache.Add(dH, dID)
+		db.cache.Add(aH, aID)
+		db.cache.Add(iH, iID)
+		n++
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("could not scan rows: %w", err)
+		return n, fmt.Errorf("could not scan rows: %w", err)
 	}
-	return entries, nil
+	return n, nil
 }
 
-// NewDB creates a new DB with the given driver and dsn as used by database/sql's Open.
-// workers specifies how many worker goroutines will be used
-func NewDB(driver, dsn string, workers int, writeInterval time.Duration) (*DB, error) {
+// openDB opens the database with the given driver and dsn, applying migrations if migrate is true or the driver always applies them
+func openDB(driver, dsn string, migrate bool) (*sql.DB, *dialect, error) {
+	dia, err := dialectFor(driver)
+	if err != nil {
+		return nil, nil, err
+	}
 	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dia.singleConn {
+		db.SetMaxOpenConns(1)
+	}
+	if migrate || dia.autoMigrate {
+		m, err := newMigrator(dia, db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		if _, err = m.Up(); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("could not migrate database: %w", err)
+		}
+	}
+	return db, dia, nil
+}
+
+// OpenDB opens a DB with the given driver and dsn for queries and administration, without starting the workers and writer that write entries.
+// Push returns ErrClosed for the returned DB. Migrations are applied if migrate is true, and always for sqlite
+func OpenDB(driver, dsn string, migrate bool) (*DB, error) {
+	db, dia, err := openDB(driver, dsn, migrate)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: db, dialect: dia, mu: new(sync.RWMutex), closed: true}, nil
+}
+
+// NewDB creates a new DB with the given driver and dsn as used by database/sql's Open.
+// Supported drivers are mysql, postgres, and sqlite. Migrations are applied automatically for sqlite.
+// If opts is nil, the defaults are used
+func NewDB(driver, dsn string, opts *Options) (*DB, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Workers <= 0 {
+		o.Workers = 10
+	}
+	if o.WriteInterval <= 0 {
+		o.WriteInterval = 15 * time.Second
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.CacheSize <= 0 {
+		o.CacheSize = 100000
+	}
+
+	db, dia, err := openDB(driver, dsn, false)
 	if err != nil {
 		return nil, err
 	}
+	if max := dia.maxParams / logColumns; o.BatchSize <= 0 || o.BatchSize > max {
+		o.BatchSize = max
+	}
+
 	d := &DB{
 		DB: db,
 
-		entries: make(chan *Entry, workers*1000),
-		inserts: make(chan *Insert, workers*1000),
+		dialect: dia,
+
+		entries: make(chan *Entry, o.Workers*1000),
+		inserts: make(chan *Insert, o.Workers*1000),
 
 		queue: make(map[int64]*Insert),
 
-		cache: NewCache(),
+		cache: NewLRUCache(o.CacheSize),
+
+		spool: o.Spool,
+
+		maxAttempts: o.MaxAttempts,
+		batchSize:   o.BatchSize,
+		sessionGap:  o.SessionGap,
+		stats:       new(Stats),
 
-		WriteInterval: writeInterval,
+		mu:         new(sync.RWMutex),
+		stop:       make(chan struct{}),
+		stopOnce:   new(sync.Once),
+		feederWG:   new(sync.WaitGroup),
+		workerWG:   new(sync.WaitGroup),
+		writerDone: make(chan error, 1),
+
+		WriteInterval: o.WriteInterval,
+	}
+
+	if o.CacheWarmup > 0 {
+		n, err := d.warmCache(time.Now().Add(-o.CacheWarmup))
+		if err != nil {
+			log.Println("Error warming cache:", err)
+		} else {
+			log.Println("Warmed cache with", n, "identities")
+		}
 	}
 
-	for i := 0; i < workers; i++ {
+	d.workerWG.Add(o.Workers)
+	for i := 0; i < o.Workers; i++ {
 		go d.worker()
 	}
 
 	go d.writer()
 
+	if d.spool != nil {
+		d.feederWG.Add(1)
+		go d.feeder()
+	}
+
 	return d, nil
 }
+
+// Close stops accepting entries, waits for queued entries to be processed and written to the database,
+// then closes the database and spool. An error is returned if any entries were lost
+func (db *DB) Close() error {
+	//opened by OpenDB, so there's nothing to stop
+	if db.stop == nil {
+		return db.DB.Close()
+	}
+
+	//signal stop before locking so blocked Pushes and the writer can return
+	var first bool
+	db.stopOnce.Do(func() {
+		close(db.stop)
+		first = true
+	})
+	if !first {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	db.closed = true
+	db.mu.Unlock()
+
+	//stop reading from the spool; unread entries stay in it until the next start
+	if db.spool != nil {
+		db.spool.Stop()
+	}
+	db.feederWG.Wait()
+
+	close(db.entries)
+	db.workerWG.Wait()
+
+	close(db.inserts)
+	err := <-db.writerDone
+
+	//close the spool after the final flush has acked its entries
+	if db.spool != nil {
+		if sErr := db.spool.Close(); sErr != nil {
+			log.Println("Error closing spool:", sErr)
+		}
+	}
+
+	if cErr := db.DB.Close(); cErr != nil && err == nil {
+		err = fmt.Errorf("could not close db: %w", cErr)
+	}
+
+	return err
+}
@@ -0,0 +1,891 @@
+package api
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const testWriteInterval = 20 * time.Millisecond
+
+// newTestDB returns a new DB backed by a temporary sqlite database
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: testWriteInterval})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// push pushes entries to db or fails the test
+func push(t testing.TB, db *DB, entries ...*Entry) {
+	t.Helper()
+	for _, e := range entries {
+		if err := db.Push(e); err != nil {
+			t.Fatal("could not push entry:", err)
+		}
+	}
+}
+
+// waitForRows waits until table contains n rows or fails the test
+func waitForRows(t testing.TB, db *DB, table string, n int) {
+	t.Helper()
+	var count int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(testWriteInterval) {
+		if err := db.DB.QueryRow(db.dialect.rebind("SELECT COUNT(*) FROM " + table)).Scan(&count); err != nil {
+			t.Fatal("could not count rows:", err)
+		}
+		if count == n {
+			return
+		}
+	}
+	t.Fatalf("%s has %d rows, expected %d", table, count, n)
+}
+
+func TestWriter(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	entries := []*Entry{
+		{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", Hostname: "host1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: now},
+		{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", Hostname: "host1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: now.Add(time.Second)},
+		{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL2", Hostname: "host2", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: now},
+	}
+	push(t, db, entries...)
+
+	waitForRows(t, db, "log", 3)
+	waitForRows(t, db, `"user"`, 2)
+	waitForRows(t, db, "device", 2)
+	waitForRows(t, db, "address", 2)
+	waitForRows(t, db, "identity", 2)
+}
+
+func TestQueryLastUser(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	push(t, db, &Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: now.Add(-time.Hour)})
+	//the last user is determined by insertion order, so make sure the older entry is committed first
+	waitForRows(t, db, "log", 1)
+	push(t, db, &Entry{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL1", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: now})
+	push(t, db, &Entry{UID: 0, Username: "root", FullName: "System Administrator", Serial: "SERIAL1", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: now.Add(time.Hour)})
+	push(t, db, &Entry{UID: 503, Username: "carol", FullName: "Carol", Serial: "SERIAL2", IP: "fe80::1", InternetIP: "2001:db8::1", Time: now})
+	waitForRows(t, db, "log", 4)
+
+	entries, err := db.QueryLastUser([]string{"SERIAL1", "SERIAL3"}, nil)
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Username != "bob" || e.Serial != "SERIAL1" || e.IP != "10.0.0.2" || !e.Time.Equal(now) {
+		t.Errorf("unexpected entry: %#v", e)
+	}
+
+	entries, err = db.QueryLastUser([]string{"SERIAL2"}, nil)
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(entries) != 1 || entries[0].IP != "fe80::1" || entries[0].InternetIP != "2001:db8::1" {
+		t.Errorf("unexpected entries: %#v", entries)
+	}
+}
+
+func TestQueryLastUserExclusion(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	push(t, db, &Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", IP: "10.0.0.1", Time: now.Add(-time.Hour)})
+	waitForRows(t, db, "log", 1)
+	push(t, db, &Entry{UID: 601, Username: "svc_backup", FullName: "Backup", Serial: "SERIAL1", IP: "10.0.0.1", Time: now})
+	waitForRows(t, db, "log", 2)
+	push(t, db, &Entry{UID: 401, Username: "breakglass", FullName: "Break Glass", Serial: "SERIAL1", IP: "10.0.0.1", Time: now.Add(time.Hour)})
+	waitForRows(t, db, "log", 3)
+
+	for _, test := range []struct {
+		exclude  *Exclusion
+		username string
+	}{
+		{nil, "breakglass"},
+		{&Exclusion{UIDRanges: []UIDRange{{0, 499}}}, "svc_backup"},
+		{&Exclusion{Prefixes: []string{"svc_"}, UIDRanges: []UIDRange{{0, 499}}}, "alice"},
+		{&Exclusion{Usernames: []string{"breakglass", "svc_backup"}}, "alice"},
+	} {
+		entries, err := db.QueryLastUser([]string{"SERIAL1"}, test.exclude)
+		if err != nil {
+			t.Fatal("could not query:", err)
+		}
+		if len(entries) != 1 || entries[0].Username != test.username {
+			t.Errorf("expected %s with exclusion %#v, got %#v", test.username, test.exclude, entries)
+		}
+	}
+
+	entries, err := db.QueryLastUser([]string{"SERIAL1"}, &Exclusion{Prefixes: []string{"a", "b", "s"}})
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries, got %#v", entries)
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	base := Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4"}
+	e1, e2, e3 := base, base, base
+	e1.Time, e2.Time, e3.Time = now.Add(-2*time.Hour), now.Add(-time.Hour), now
+	e1.OSVersion, e1.OSBuild, e1.Model, e1.ClientVersion = "14.4", "23E214", "MacBookPro18,3", "2.0.0"
+	e1.MACAddresses = []string{"AA:BB:CC:DD:EE:FF", "00:11:22:33:44:55"}
+	e2.OSVersion, e2.OSBuild, e2.Model, e2.ClientVersion = "14.4", "23E214", "MacBookPro18,3", "2.0.0"
+	e2.MACAddresses = []string{"00-11-22-33-44-55", "aa:bb:cc:dd:ee:ff"}
+
+	push(t, db, &e1)
+	waitForRows(t, db, "log", 1)
+	push(t, db, &e2)
+	waitForRows(t, db, "log", 2)
+	push(t, db, &e3)
+	waitForRows(t, db, "log", 3)
+	waitForRows(t, db, "platform", 1)
+	waitForRows(t, db, "identity", 1)
+
+	var macs string
+	if err := db.DB.QueryRow("SELECT mac_addresses FROM platform").Scan(&macs); err != nil {
+		t.Fatal("could not query platform:", err)
+	}
+	if macs != "00:11:22:33:44:55,aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected mac_addresses: %s", macs)
+	}
+	waitForRows(t, db, "log WHERE platform_id IS NULL", 1)
+
+	entries, err := db.QueryLastUser([]string{"SERIAL1"}, nil)
+	if err != nil {
+		t.Fatal("could not query last user:", err)
+	}
+	if len(entries) != 1 || entries[0].OSVersion != "" || entries[0].MACAddresses != nil {
+		t.Errorf("expected last entry without platform, got %#v", entries)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	push(t, db,
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", Time: now.Add(-time.Hour), Attributes: map[string]string{"lab": "A", "mdm": "yes"}},
+		&Entry{Username: "bob", Serial: "SERIAL2", IP: "10.0.0.2", Time: now, Attributes: map[string]string{"mdm": "yes", "lab": "A"}},
+		&Entry{Username: "carol", Serial: "SERIAL3", IP: "10.0.0.3", Time: now, Attributes: map[string]string{"lab": "B"}},
+		&Entry{Username: "dave", Serial: "SERIAL4", IP: "10.0.0.4", Time: now},
+	)
+	waitForRows(t, db, "log", 4)
+	waitForRows(t, db, "attribute", 3)
+	waitForRows(t, db, "attribute_set", 2)
+	waitForRows(t, db, "attribute_set_member", 3)
+
+	entries, err := db.QueryAttribute(&AttributeQuery{Key: "lab"})
+	if err != nil {
+		t.Fatal("could not query attribute:", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	value := "A"
+	entries, err = db.QueryAttribute(&AttributeQuery{Key: "lab", Value: &value, Limit: 1})
+	if err != nil {
+		t.Fatal("could not query attribute:", err)
+	}
+	if len(entries) != 1 || entries[0].Attributes["lab"] != "A" || entries[0].Attributes["mdm"] != "yes" {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+
+	entries, err = db.QueryLastUser([]string{"SERIAL3", "SERIAL4"}, nil)
+	if err != nil {
+		t.Fatal("could not query last user:", err)
+	}
+	for _, e := range entries {
+		if (e.Serial == "SERIAL3") != (e.Attributes["lab"] == "B") || (e.Serial == "SERIAL4" && e.Attributes != nil) {
+			t.Errorf("unexpected attributes for %s: %v", e.Serial, e.Attributes)
+		}
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	//same time as the previous entry to check pagination doesn't skip ties
+	times := []time.Duration{0, time.Hour, time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour}
+	for idx, d := range times {
+		push(t, db, &Entry{Username: "user" + strconv.Itoa(idx), Serial: "SERIAL1", IP: "10.0.0.1", Time: start.Add(d).In(time.FixedZone("", -6*3600))})
+	}
+	push(t, db, &Entry{Username: "other", Serial: "SERIAL2", IP: "10.0.0.2", Time: start.Add(time.Hour)})
+	waitForRows(t, db, "log", len(times)+1)
+
+	q := &HistoryQuery{Serial: "SERIAL1", Start: start.Add(time.Hour), End: start.Add(4 * time.Hour), Limit: 2}
+	var entries []*Entry
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		page, err := db.QueryHistory(q)
+		if err != nil {
+			t.Fatal("could not query history:", err)
+		}
+		entries = append(entries, page.Entries...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	seen := make(map[string]bool)
+	for idx, e := range entries {
+		if e.Serial != "SERIAL1" || seen[e.Username] {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+		seen[e.Username] = true
+		if idx > 0 && e.Time.Before(entries[idx-1].Time) {
+			t.Error("expected entries to be ordered by time")
+		}
+	}
+	if !entries[3].Time.Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("expected last entry at %v, got %v", start.Add(3*time.Hour), entries[3].Time)
+	}
+
+	if _, err := db.QueryHistory(&HistoryQuery{Serial: "SERIAL1", Cursor: "invalid"}); err != ErrInvalidCursor {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestQueryIP(t *testing.T) {
+	db := newTestDB(t)
+	at := time.Date(2024, 1, 1, 14, 32, 0, 0, time.UTC)
+
+	push(t, db,
+		//bracketed
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(-10 * time.Minute)},
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(-5 * time.Minute)},
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(20 * time.Minute)},
+		//only before, but closer
+		&Entry{Username: "bob", Serial: "SERIAL2", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(-time.Minute)},
+		//outside of tolerance
+		&Entry{Username: "carol", Serial: "SERIAL3", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(-2 * time.Hour)},
+		//different address
+		&Entry{Username: "dave", Serial: "SERIAL4", IP: "10.0.0.6", InternetIP: "1.2.3.4", Time: at},
+	)
+	waitForRows(t, db, "log", 6)
+
+	matches, err := db.QueryIP("10.0.0.5", "", at, time.Hour)
+	if err != nil {
+		t.Fatal("could not query ip:", err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+
+	m := matches[0]
+	if m.Username != "alice" || !m.Bracketed || !m.Before.Equal(at.Add(-5*time.Minute)) || !m.After.Equal(at.Add(20*time.Minute)) {
+		t.Errorf("unexpected first match: %#v", m)
+	}
+	if !m.Time.Equal(at.Add(-5 * time.Minute)) {
+		t.Errorf("expected nearest entry at %v, got %v", at.Add(-5*time.Minute), m.Time)
+	}
+	if m = matches[1]; m.Username != "bob" || m.Bracketed || m.After != nil {
+		t.Errorf("unexpected second match: %#v", m)
+	}
+
+	if matches, err = db.QueryIP("", "1.2.3.4", at, time.Minute); err != nil || len(matches) != 2 {
+		t.Errorf("expected 2 matches by internet ip, got %d, %v", len(matches), err)
+	}
+	if _, err = db.QueryIP("", "", at, time.Hour); err != ErrMissingAddress {
+		t.Errorf("expected ErrMissingAddress, got %v", err)
+	}
+	if _, err = db.QueryIP("not an ip", "", at, time.Hour); err == nil {
+		t.Error("expected invalid address error")
+	}
+}
+
+func TestQueryIPBusyAddress(t *testing.T) {
+	db := newTestDB(t)
+	at := time.Date(2024, 1, 1, 14, 32, 0, 0, time.UTC)
+
+	push(t, db,
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.5", InternetIP: "1.2.3.4", Time: at.Add(-30 * time.Minute)},
+		&Entry{Username: "erin", Serial: "SERIAL5", IP: "10.0.0.7", InternetIP: "1.2.3.4", Time: at.Add(10 * time.Minute)},
+	)
+	waitForRows(t, db, "log", 2)
+
+	//fill the window before the queried time with more entries than a query returns
+	var identityID int
+	if err := db.DB.QueryRow(`SELECT identity.id FROM identity INNER JOIN "user" ON identity.user_id = "user".id WHERE "user".username = 'alice'`).Scan(&identityID); err != nil {
+		t.Fatal("could not query identity:", err)
+	}
+	if _, err := db.DB.Exec(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < ?)
+		INSERT INTO log(identity_id, time) SELECT ?, ? FROM n`, MaxQueryLimit, identityID, at.Add(-20*time.Minute)); err != nil {
+		t.Fatal("could not insert entries:", err)
+	}
+
+	matches, err := db.QueryIP("", "1.2.3.4", at, time.Hour)
+	if err != nil {
+		t.Fatal("could not query ip:", err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if m := matches[0]; m.Username != "erin" || m.After == nil || !m.After.Equal(at.Add(10*time.Minute)) {
+		t.Errorf("unexpected first match: %#v", m)
+	}
+	if m := matches[1]; m.Username != "alice" || m.Before == nil || !m.Before.Equal(at.Add(-20*time.Minute)) || m.After != nil {
+		t.Errorf("unexpected second match: %#v", m)
+	}
+}
+
+func TestQueryUser(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	push(t, db,
+		&Entry{UID: 501, Username: "alice", FullName: "Alice Smith", Serial: "SERIAL1", Hostname: "host1", IP: "10.0.0.1", Time: start},
+		&Entry{UID: 501, Username: "alice", FullName: "Alice Smith", Serial: "SERIAL1", Hostname: "host1", IP: "10.0.0.2", Time: start.Add(time.Hour)},
+		&Entry{UID: 501, Username: "alice", FullName: "Alice Smith", Serial: "SERIAL1", Hostname: "host1", IP: "10.0.0.1", Time: start.Add(2 * time.Hour)},
+		&Entry{UID: 501, Username: "alice", FullName: "Alice Smith", Serial: "SERIAL2", Hostname: "host2", IP: "10.0.0.3", Time: start.Add(3 * time.Hour)},
+		&Entry{UID: 502, Username: "asmith", FullName: "Alex Smith_", Serial: "SERIAL3", Hostname: "host3", IP: "10.0.0.4", Time: start},
+	)
+	waitForRows(t, db, "log", 5)
+
+	devices, err := db.QueryUser(&UserQuery{Username: "alice"})
+	if err != nil {
+		t.Fatal("could not query user:", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+	if d := devices[0]; d.Serial != "SERIAL2" || d.CheckIns != 1 {
+		t.Errorf("unexpected first device: %#v", d)
+	}
+	if d := devices[1]; d.Serial != "SERIAL1" || d.Hostname != "host1" || d.CheckIns != 3 ||
+		!d.FirstSeen.Equal(start) || !d.LastSeen.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("unexpected second device: %#v", d)
+	}
+
+	if devices, err = db.QueryUser(&UserQuery{FullName: "SMITH"}); err != nil || len(devices) != 3 {
+		t.Errorf("expected 3 devices by full name, got %d, %v", len(devices), err)
+	}
+	if devices, err = db.QueryUser(&UserQuery{FullName: "h_"}); err != nil || len(devices) != 1 || devices[0].Username != "asmith" {
+		t.Errorf("expected wildcards to be escaped, got %v, %v", devices, err)
+	}
+	if _, err = db.QueryUser(&UserQuery{}); err != ErrMissingUser {
+		t.Errorf("expected ErrMissingUser, got %v", err)
+	}
+}
+
+func TestQueryStale(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	push(t, db,
+		&Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", ClientIdentifier: "com.example.chronicle", Hostname: "host1", IP: "10.0.0.1", Time: now.AddDate(0, 0, -40)},
+		&Entry{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL2", ClientIdentifier: "com.example.chronicle", Hostname: "host2", IP: "10.0.0.2", Time: now.AddDate(0, 0, -35)},
+		&Entry{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL2", ClientIdentifier: "com.example.chronicle", Hostname: "host2", IP: "10.0.0.2", Time: now.AddDate(0, 0, -50)},
+		&Entry{UID: 503, Username: "carol", FullName: "Carol", Serial: "SERIAL3", ClientIdentifier: "com.example.legacy", Hostname: "host3", IP: "10.0.0.3", Time: now.AddDate(0, 0, -60)},
+		&Entry{UID: 504, Username: "dave", FullName: "Dave", Serial: "SERIAL4", ClientIdentifier: "com.example.chronicle", Hostname: "host4", IP: "10.0.0.4", Time: now.AddDate(0, 0, -40)},
+		&Entry{UID: 504, Username: "dave", FullName: "Dave", Serial: "SERIAL4", ClientIdentifier: "com.example.chronicle", Hostname: "host4", IP: "10.0.0.4", Time: now.AddDate(0, 0, -1)},
+	)
+	waitForRows(t, db, "log", 6)
+
+	report, err := db.QueryStale(now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal("could not query stale devices:", err)
+	}
+	if len(report) != 2 || report[0].ClientIdentifier != "com.example.chronicle" || report[1].ClientIdentifier != "com.example.legacy" {
+		t.Fatalf("unexpected groups: %#v", report)
+	}
+	if devices := report[0].Devices; len(devices) != 2 ||
+		devices[0].Serial != "SERIAL1" || !devices[0].LastSeen.Equal(now.AddDate(0, 0, -40)) ||
+		devices[1].Serial != "SERIAL2" || devices[1].Username != "bob" || !devices[1].LastSeen.Equal(now.AddDate(0, 0, -35)) {
+		t.Errorf("unexpected devices: %#v, %#v", devices[0], devices[1])
+	}
+	if devices := report[1].Devices; len(devices) != 1 || devices[0].Serial != "SERIAL3" {
+		t.Errorf("unexpected devices: %#v", devices)
+	}
+
+	if report, err = db.QueryStale(now.AddDate(0, 0, -90)); err != nil || len(report) != 0 {
+		t.Errorf("expected empty report, got %#v, %v", report, err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: testWriteInterval, SessionGap: 30 * time.Minute})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	defer db.Close()
+
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	alice := func(minutes int) *Entry {
+		return &Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", IP: "10.0.0.1", Time: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	push(t, db, alice(0), alice(15), alice(30))
+	waitForRows(t, db, "log", 3)
+	waitForRows(t, db, "session", 1)
+
+	push(t, db, alice(90))
+	waitForRows(t, db, "log", 4)
+	waitForRows(t, db, "session", 2)
+
+	//bridges the gap between both sessions
+	push(t, db, alice(60))
+	waitForRows(t, db, "log", 5)
+	waitForRows(t, db, "session", 1)
+
+	push(t, db, &Entry{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL2", IP: "10.0.0.2", Time: start.Add(3 * time.Hour)})
+	waitForRows(t, db, "log", 6)
+	waitForRows(t, db, "session", 2)
+
+	sessions, err := db.QuerySessions(&SessionQuery{})
+	if err != nil {
+		t.Fatal("could not query sessions:", err)
+	}
+	if len(sessions) != 2 || sessions[0].Username != "bob" || sessions[1].Username != "alice" {
+		t.Fatalf("unexpected sessions: %#v", sessions)
+	}
+	if s := sessions[1]; !s.Start.Equal(start) || !s.End.Equal(start.Add(90*time.Minute)) || s.CheckIns != 5 || s.Serial != "SERIAL1" || s.IP != "10.0.0.1" {
+		t.Errorf("unexpected session: %#v", s)
+	}
+
+	for _, test := range []struct {
+		query    *SessionQuery
+		expected int
+	}{
+		{&SessionQuery{Serial: "SERIAL1"}, 1},
+		{&SessionQuery{Username: "bob"}, 1},
+		{&SessionQuery{Start: start.Add(2 * time.Hour)}, 1},
+		{&SessionQuery{End: start.Add(time.Hour)}, 1},
+		{&SessionQuery{Start: start.Add(time.Hour), End: start.Add(4 * time.Hour)}, 2},
+		{&SessionQuery{Limit: 1}, 1},
+	} {
+		if sessions, err = db.QuerySessions(test.query); err != nil || len(sessions) != test.expected {
+			t.Errorf("expected %d sessions for %#v, got %d, %v", test.expected, test.query, len(sessions), err)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := newTestDB(t)
+
+	key, k, err := db.CreateAPIKey("ops", []Scope{ScopeQuery, ScopeExport}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("could not create key:", err)
+	}
+	if !strings.HasPrefix(key, keyPrefix) || k.ID == 0 || k.ExpiresAt == nil {
+		t.Errorf("unexpected key: %s, %#v", key, k)
+	}
+	if _, _, err = db.CreateAPIKey("ops", []Scope{ScopeQuery}, time.Time{}); err == nil {
+		t.Error("expected error for duplicate name")
+	}
+	if _, _, err = db.CreateAPIKey("admin", []Scope{ScopeAdmin}, time.Time{}); err != nil {
+		t.Fatal("could not create key:", err)
+	}
+
+	keys, err := db.ListAPIKeys()
+	if err != nil {
+		t.Fatal("could not list keys:", err)
+	}
+	if len(keys) != 2 || keys[0].Name != "admin" || keys[0].ExpiresAt != nil || keys[1].Name != "ops" ||
+		len(keys[1].Scopes) != 2 || !keys[1].ExpiresAt.Equal(*k.ExpiresAt) || keys[1].Revoked {
+		t.Errorf("unexpected keys: %#v", keys)
+	}
+
+	store := NewKeyStore(db, time.Nanosecond)
+	if found, err := store.Authenticate(key); err != nil || found.Name != "ops" || !found.HasScope(ScopeQuery) || found.HasScope(ScopeSubmit) {
+		t.Errorf("unexpected key: %#v, %v", found, err)
+	}
+	if _, err = store.Authenticate(key + "x"); err != ErrInvalidAPIKey {
+		t.Errorf("expected ErrInvalidAPIKey, got %v", err)
+	}
+
+	if err = db.RevokeAPIKey("ops"); err != nil {
+		t.Fatal("could not revoke key:", err)
+	}
+	if err = db.RevokeAPIKey("ops"); err != nil {
+		t.Errorf("expected revoking a revoked key to succeed, got %v", err)
+	}
+	if err = db.RevokeAPIKey("missing"); err != ErrUnknownKey {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err = store.Authenticate(key); err != ErrRevokedAPIKey {
+		t.Errorf("expected ErrRevokedAPIKey, got %v", err)
+	}
+
+	expired, _, err := db.CreateAPIKey("expired", []Scope{ScopeSubmit}, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal("could not create key:", err)
+	}
+	if _, err = store.Authenticate(expired); err != ErrExpiredAPIKey {
+		t.Errorf("expected ErrExpiredAPIKey, got %v", err)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	db := newTestDB(t)
+
+	expired, err := db.CreateEnrollmentSecret(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal("could not create secret:", err)
+	}
+	if _, err = db.Enroll(expired, "SERIAL1"); err != ErrInvalidSecret {
+		t.Errorf("expected ErrInvalidSecret for expired secret, got %v", err)
+	}
+	if _, err = db.Enroll("enr_missing", "SERIAL1"); err != ErrInvalidSecret {
+		t.Errorf("expected ErrInvalidSecret for unknown secret, got %v", err)
+	}
+
+	var secrets []string
+	for i := 0; i < 2; i++ {
+		secret, err := db.CreateEnrollmentSecret(time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal("could not create secret:", err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	token, err := db.Enroll(secrets[0], "SERIAL1")
+	if err != nil {
+		t.Fatal("could not enroll:", err)
+	}
+
+	//a second secret can't take over an enrolled serial, and isn't used up trying
+	if _, err = db.Enroll(secrets[1], "SERIAL1"); err != ErrEnrolled {
+		t.Errorf("expected ErrEnrolled, got %v", err)
+	}
+	store := NewTokenStore(db, time.Nanosecond)
+	if serial, err := store.Serial(token); err != nil || serial != "SERIAL1" {
+		t.Errorf("expected original token to still be valid for SERIAL1, got %q, %v", serial, err)
+	}
+
+	if err = db.RevokeDeviceToken("SERIAL1"); err != nil {
+		t.Fatal("could not revoke token:", err)
+	}
+	if err = db.RevokeDeviceToken("SERIAL1"); err != ErrUnknownDevice {
+		t.Errorf("expected ErrUnknownDevice, got %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if serial, err := store.Serial(token); err != nil || serial != "" {
+		t.Errorf("expected revoked token to be invalid, got %q, %v", serial, err)
+	}
+
+	//after revoking, the unused secret can re-enroll the serial
+	if token, err = db.Enroll(secrets[1], "SERIAL1"); err != nil {
+		t.Fatal("could not re-enroll:", err)
+	}
+	if serial, err := store.Serial(token); err != nil || serial != "SERIAL1" {
+		t.Errorf("expected SERIAL1, got %q, %v", serial, err)
+	}
+}
+
+func TestCacheWarmup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chronicle.db")
+	db, err := NewDB("sqlite", path, &Options{Workers: 2, WriteInterval: testWriteInterval})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+
+	now := time.Now()
+	recent := &Entry{UID: 501, Username: "alice", FullName: "Alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: now}
+	old := &Entry{UID: 502, Username: "bob", FullName: "Bob", Serial: "SERIAL2", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: now.Add(-48 * time.Hour)}
+	push(t, db, recent, old)
+	waitForRows(t, db, "log", 2)
+	if err = db.Close(); err != nil {
+		t.Fatal("could not close db:", err)
+	}
+
+	db, err = NewDB("sqlite", path, &Options{Workers: 2, WriteInterval: testWriteInterval, CacheWarmup: 24 * time.Hour})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	defer db.Close()
+
+	if n := db.cache.Len(); n != 4 {
+		t.Errorf("expected 4 cached IDs, got %d", n)
+	}
+	_, _, _, iH := recent.Hashes()
+	if db.cache.Get(iH) == 0 {
+		t.Error("expected recent identity to be cached")
+	}
+	_, _, _, iH = old.Hashes()
+	if db.cache.Get(iH) != 0 {
+		t.Error("expected old identity not to be cached")
+	}
+
+	s := db.Stats().Cache
+	if s.Hits != 1 || s.Misses != 1 || s.Capacity != 100000 {
+		t.Errorf("unexpected cache stats: %#v", s)
+	}
+}
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chronicle.db")
+	db, err := NewDB("sqlite", path, &Options{Workers: 2, WriteInterval: time.Hour})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		push(t, db, &Entry{UID: uint32(i), Username: "user", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()})
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal("could not close db:", err)
+	}
+	if err = db.Push(&Entry{}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err = db.Close(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	sqlDB, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal("could not open db:", err)
+	}
+	defer sqlDB.Close()
+	var count int
+	if err = sqlDB.QueryRow("SELECT COUNT(*) FROM log").Scan(&count); err != nil {
+		t.Fatal("could not count rows:", err)
+	}
+	if count != 100 {
+		t.Errorf("expected 100 rows, got %d", count)
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	db, err := OpenDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), false)
+	if err != nil {
+		t.Fatal("could not open db:", err)
+	}
+
+	//sqlite is always migrated
+	if _, err = db.QueryStale(time.Now()); err != nil {
+		t.Error("could not query db:", err)
+	}
+	if err = db.Push(&Entry{}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Error("could not close db:", err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	for _, permanent := range []bool{true, false} {
+		if !permanent {
+			//treat all errors as retryable
+			orig := dialects["sqlite"]
+			dia := *orig
+			dia.permanent = func(error) bool { return false }
+			dialects["sqlite"] = &dia
+			defer func() { dialects["sqlite"] = orig }()
+		}
+		db := newTestDB(t)
+
+		//entries with a serial of POISON can never be written
+		if _, err := db.DB.Exec(`CREATE TRIGGER poison BEFORE INSERT ON device WHEN NEW.serial = 'POISON' BEGIN SELECT RAISE(ABORT, 'poisoned'); END`); err != nil {
+			t.Fatal("could not create trigger:", err)
+		}
+
+		push(t, db,
+			&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()},
+			&Entry{UID: 502, Username: "bob", Serial: "POISON", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: time.Now()},
+		)
+
+		waitForRows(t, db, "log", 1)
+		waitForRows(t, db, "dead_letter", 1)
+
+		var (
+			entry    string
+			attempts int
+		)
+		if err := db.DB.QueryRow("SELECT entry, attempts FROM dead_letter").Scan(&entry, &attempts); err != nil {
+			t.Fatal("could not query dead letter:", err)
+		}
+		if !strings.Contains(entry, `"serial":"POISON"`) {
+			t.Errorf("unexpected dead letter entry: %s", entry)
+		}
+
+		stats := db.Stats()
+		if permanent && (attempts != 1 || stats.Retried != 0) {
+			t.Errorf("expected permanent error to be dead-lettered immediately, got %d attempts, %d retries", attempts, stats.Retried)
+		}
+		if !permanent && (attempts != db.maxAttempts || stats.Retried != int64(db.maxAttempts-1)) {
+			t.Errorf("expected retryable error to be tried %d times, got %d attempts, %d retries", db.maxAttempts, attempts, stats.Retried)
+		}
+		if stats.Written != 1 || stats.DeadLettered != 1 {
+			t.Errorf("unexpected stats: %#v", stats)
+		}
+	}
+}
+
+func TestDeadLetterFailure(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.DB.Exec(`CREATE TRIGGER poison BEFORE INSERT ON device WHEN NEW.serial = 'POISON' BEGIN SELECT RAISE(ABORT, 'poisoned'); END`); err != nil {
+		t.Fatal("could not create trigger:", err)
+	}
+	if _, err := db.DB.Exec(`CREATE TRIGGER broken BEFORE INSERT ON dead_letter BEGIN SELECT RAISE(ABORT, 'broken'); END`); err != nil {
+		t.Fatal("could not create trigger:", err)
+	}
+
+	push(t, db,
+		&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()},
+		&Entry{UID: 502, Username: "bob", Serial: "POISON", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: time.Now()},
+	)
+	waitForRows(t, db, "log", 1)
+
+	//the entry is kept for the next flush until the dead letter can be written
+	for deadline := time.Now().Add(5 * time.Second); db.Stats().Retried == 0 && time.Now().Before(deadline); time.Sleep(testWriteInterval) {
+	}
+	if stats := db.Stats(); stats.Written != 1 || stats.DeadLettered != 0 || stats.Retried == 0 || stats.FailedBatches != 0 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+	if _, err := db.DB.Exec("DROP TRIGGER broken"); err != nil {
+		t.Fatal("could not drop trigger:", err)
+	}
+	waitForRows(t, db, "dead_letter", 1)
+}
+
+func TestSessionFailure(t *testing.T) {
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: testWriteInterval, SessionGap: 30 * time.Minute})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	defer db.Close()
+
+	//sessions for the device with a serial of POISON can never be written
+	if _, err = db.DB.Exec(`CREATE TRIGGER poison BEFORE INSERT ON session WHEN NEW.identity_id = (SELECT identity.id FROM identity INNER JOIN device ON identity.device_id = device.id WHERE device.serial = 'POISON') BEGIN SELECT RAISE(ABORT, 'poisoned'); END`); err != nil {
+		t.Fatal("could not create trigger:", err)
+	}
+
+	push(t, db,
+		&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", Time: time.Now()},
+		&Entry{UID: 502, Username: "bob", Serial: "POISON", IP: "10.0.0.2", Time: time.Now()},
+	)
+	waitForRows(t, db, "log", 1)
+	waitForRows(t, db, "session", 1)
+	waitForRows(t, db, "dead_letter", 1)
+}
+
+func TestTransactionFailure(t *testing.T) {
+	db := newTestDB(t)
+
+	//log entries for the device with a serial of POISON roll back the whole transaction, like an aborted PostgreSQL transaction
+	if _, err := db.DB.Exec(`CREATE TRIGGER poison BEFORE INSERT ON log WHEN NEW.identity_id = (SELECT identity.id FROM identity INNER JOIN device ON identity.device_id = device.id WHERE device.serial = 'POISON') BEGIN SELECT RAISE(ROLLBACK, 'poisoned'); END`); err != nil {
+		t.Fatal("could not create trigger:", err)
+	}
+
+	push(t, db, &Entry{UID: 502, Username: "bob", Serial: "POISON", IP: "10.0.0.2", Time: time.Now()})
+	waitForRows(t, db, "dead_letter", 1)
+
+	var attempts int
+	if err := db.DB.QueryRow("SELECT attempts FROM dead_letter").Scan(&attempts); err != nil {
+		t.Fatal("could not query dead letter:", err)
+	}
+	if stats := db.Stats(); attempts != db.maxAttempts || stats.FailedBatches != int64(db.maxAttempts) {
+		t.Errorf("expected %d attempts and failed batches, got %d, %#v", db.maxAttempts, attempts, stats)
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	db := newTestDB(t)
+
+	//log entries for the device with a serial of POISON can never be written
+	if _, err := db.DB.Exec(`CREATE TRIGGER poison BEFORE INSERT ON log WHEN NEW.identity_id = (SELECT identity.id FROM identity INNER JOIN device ON identity.device_id = device.id WHERE device.serial = 'POISON') BEGIN SELECT RAISE(ABORT, 'poisoned'); END`); err != nil {
+		t.Fatal("could not create trigger:", err)
+	}
+
+	var entries []*Entry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &Entry{UID: uint32(i), Username: "user", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()})
+	}
+	entries = append(entries, &Entry{UID: 1, Username: "user", Serial: "POISON", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()})
+	push(t, db, entries...)
+
+	waitForRows(t, db, "log", 10)
+	waitForRows(t, db, "dead_letter", 1)
+}
+
+// BenchmarkFlush measures writing log entries for already known identities with multi-row and single-row INSERTs
+func BenchmarkFlush(b *testing.B) {
+	const entries = 1000
+
+	for _, bench := range []struct {
+		name      string
+		batchSize int
+	}{{"PerRow", 1}, {"Batched", 0}} {
+		b.Run(bench.name, func(b *testing.B) {
+			db, err := NewDB("sqlite", filepath.Join(b.TempDir(), "chronicle.db"), &Options{Workers: 1, WriteInterval: time.Hour, BatchSize: bench.batchSize})
+			if err != nil {
+				b.Fatal("could not create db:", err)
+			}
+			defer db.Close()
+
+			stmts := db.prepareStmts()
+			lCache := NewCache()
+
+			//create identity
+			e := &Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()}
+			u, d, a, i := e.Hashes()
+			ip, _ := parseIP(e.IP)
+			internetIP, _ := parseIP(e.InternetIP)
+			db.queue[0] = &Insert{
+				User:         &User{UID: e.UID, Username: e.Username},
+				Device:       &Device{Serial: e.Serial},
+				Address:      &Address{IP: ip, InternetIP: internetIP},
+				Identity:     &Identity{},
+				LogEntry:     &LogEntry{Time: e.Time},
+				UserHash:     u,
+				DeviceHash:   d,
+				AddressHash:  a,
+				IdentityHash: i,
+				entry:        e,
+			}
+			if err = db.flush(stmts, lCache); err != nil {
+				b.Fatal("could not flush:", err)
+			}
+			identityID := db.cache.Get(i)
+
+			b.ResetTimer()
+			start := time.Now()
+			for n := 0; n < b.N; n++ {
+				for k := 0; k < entries; k++ {
+					db.queue[int64(k)] = &Insert{
+						LogEntry:   &LogEntry{IdentityID: identityID, Time: time.Now()},
+						IdentityID: identityID,
+						entry:      e,
+					}
+				}
+				if err = db.flush(stmts, lCache); err != nil {
+					b.Fatal("could not flush:", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*entries)/time.Since(start).Seconds(), "entries/s")
+			closeStmts(stmts)
+		})
+	}
+}
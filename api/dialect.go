@@ -0,0 +1,203 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dialect represents the differences between SQL databases.
+// Queries are written with ? placeholders and "quoted" identifiers and rewritten with rebind
+type dialect struct {
+	Name string
+
+	// placeholder returns the nth (starting at 1) bind parameter
+	placeholder func(n int) string
+
+	// quote is the character used to quote identifiers
+	quote byte
+
+	// returning is true if inserted ids are returned with INSERT ... RETURNING id instead of LastInsertId
+	returning bool
+
+	// maxParams is the maximum number of bind parameters allowed in a single statement
+	maxParams int
+
+	// singleConn is true if the database can only be safely used with one open connection
+	singleConn bool
+
+	// autoMigrate is true if migrations are always applied when the database is opened
+	autoMigrate bool
+
+	// permanent returns true if err is caused by the data being written and will never succeed if retried
+	permanent func(err error) bool
+
+	// applied returns true if err is caused by a migration statement whose change was already made.
+	// It's only set for databases that can't roll back DDL, so a migration that failed partway can be run again
+	applied func(err error) bool
+}
+
+// mysqlPermanent returns true for MySQL data errors
+func mysqlPermanent(err error) bool {
+	var mErr *mysql.MySQLError
+	if !errors.As(err, &mErr) {
+		return false
+	}
+	switch mErr.Number {
+	case 1048, //column cannot be null
+		1264, //out of range value
+		1292, //incorrect value
+		1366, //incorrect string value
+		1406, //data too long
+		1452: //foreign key constraint fails
+		return true
+	}
+	return false
+}
+
+// mysqlApplied returns true for MySQL errors from creating tables, columns, or indexes that already exist,
+// or dropping ones that don't
+func mysqlApplied(err error) bool {
+	var mErr *mysql.MySQLError
+	if !errors.As(err, &mErr) {
+		return false
+	}
+	switch mErr.Number {
+	case 1050, //table already exists
+		1051, //unknown table
+		1060, //duplicate column name
+		1061, //duplicate key name
+		1091: //can't drop column or key; check that it exists
+		return true
+	}
+	return false
+}
+
+// postgresPermanent returns true for PostgreSQL data exceptions and integrity constraint violations.
+// Unique violations are retried, since they're caused by concurrent inserts of the same row
+func postgresPermanent(err error) bool {
+	var pErr *pq.Error
+	if !errors.As(err, &pErr) {
+		return false
+	}
+	switch pErr.Code.Class() {
+	case "22":
+		return true
+	case "23":
+		return pErr.Code != "23505"
+	}
+	return false
+}
+
+// sqlitePermanent returns true for SQLite constraint, size, and type errors.
+// Unique violations are retried, since they're caused by concurrent inserts of the same row
+func sqlitePermanent(err error) bool {
+	var sErr *sqlite.Error
+	if !errors.As(err, &sErr) {
+		return false
+	}
+	switch sErr.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT:
+		return sErr.Code() != sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	case sqlite3.SQLITE_TOOBIG, sqlite3.SQLITE_MISMATCH:
+		return true
+	}
+	return false
+}
+
+var dialects = map[string]*dialect{
+	"mysql": {
+		Name:        "mysql",
+		placeholder: func(int) string { return "?" },
+		quote:       '`',
+		maxParams:   65535,
+		permanent:   mysqlPermanent,
+		applied:     mysqlApplied,
+	},
+	"postgres": {
+		Name:        "postgres",
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		quote:       '"',
+		returning:   true,
+		maxParams:   65535,
+		permanent:   postgresPermanent,
+	},
+	"sqlite": {
+		Name:        "sqlite",
+		placeholder: func(int) string { return "?" },
+		quote:       '"',
+		maxParams:   32766,
+		singleConn:  true,
+		autoMigrate: true,
+		permanent:   sqlitePermanent,
+	},
+}
+
+// dialectFor returns the dialect for the given database/sql driver name
+func dialectFor(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported driver: %s", driver)
+	}
+	return d, nil
+}
+
+// rebind rewrites query's placeholders and quoted identifiers to the dialect's syntax.
+// Characters inside string literals are left alone
+func (d *dialect) rebind(query string) string {
+	var (
+		b       strings.Builder
+		n       int
+		literal bool
+	)
+	b.Grow(len(query))
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			literal = !literal
+			b.WriteByte(c)
+		case literal:
+			b.WriteByte(c)
+		case c == '?':
+			n++
+			b.WriteString(d.placeholder(n))
+		case c == '"':
+			b.WriteByte(d.quote)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// insert returns the rebound query for an INSERT statement that creates a row with an id column
+func (d *dialect) insert(query string) string {
+	if d.returning {
+		query += " RETURNING id"
+	}
+	return d.rebind(query)
+}
+
+// insertID executes stmt (created with insert) and returns the id of the new row
+func (d *dialect) insertID(stmt *sql.Stmt, args ...interface{}) (int, error) {
+	if d.returning {
+		var id int
+		err := stmt.QueryRow(args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
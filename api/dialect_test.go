@@ -0,0 +1,31 @@
+package api
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := `SELECT "user".id FROM "user" WHERE username=? AND fullname <> '?"' AND uid=?`
+	tests := map[string]string{
+		"mysql":    "SELECT `user`.id FROM `user` WHERE username=? AND fullname <> '?\"' AND uid=?",
+		"postgres": `SELECT "user".id FROM "user" WHERE username=$1 AND fullname <> '?"' AND uid=$2`,
+		"sqlite":   `SELECT "user".id FROM "user" WHERE username=? AND fullname <> '?"' AND uid=?`,
+	}
+	for driver, expected := range tests {
+		d, err := dialectFor(driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := d.rebind(query); q != expected {
+			t.Errorf("%s: expected %q, got %q", driver, expected, q)
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	query := `INSERT INTO address(ip, internetip) VALUES(?, ?)`
+	if q := dialects["postgres"].insert(query); q != `INSERT INTO address(ip, internetip) VALUES($1, $2) RETURNING id` {
+		t.Errorf("unexpected postgres insert: %q", q)
+	}
+	if q := dialects["mysql"].insert(query); q != query {
+		t.Errorf("unexpected mysql insert: %q", q)
+	}
+}
@@ -1,25 +1,146 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// ErrorResponse is the body returned for a request with invalid entries
+type ErrorResponse struct {
+	Status int              `json:"status"`
+	Errors ValidationErrors `json:"errors"`
+}
+
+// writeValidationErrors writes status with an ErrorResponse for errs
+func writeValidationErrors(rw http.ResponseWriter, status int, errs ValidationErrors) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(&ErrorResponse{Status: status, Errors: errs}); err != nil {
+		log.Println("couldn't encode body:", err)
+	}
+}
+
+// requestSerial returns the serial of r's device token if device tokens are checked.
+// sent is false if r didn't include a token, and serial is empty if the token isn't valid
+func (c *Context) requestSerial(r *http.Request) (serial string, sent bool, err error) {
+	if c.TokenMode == "" || c.TokenMode == TokenModeOff {
+		return "", false, nil
+	}
+	token := r.Header.Get(DeviceTokenHeader)
+	if token == "" {
+		return "", false, nil
+	}
+	if c.Tokens == nil {
+		return "", true, nil
+	}
+	serial, err = c.Tokens.Serial(token)
+	return serial, true, err
+}
+
+// checkToken checks e against the serial of the request's device token, as returned by requestSerial.
+// If the token is missing or doesn't match, a ValidationError is returned in TokenModeReject, or e is flagged with TokenAttribute in TokenModeFlag
+func (c *Context) checkToken(e *Entry, serial string, sent bool) *ValidationError {
+	if c.TokenMode == "" || c.TokenMode == TokenModeOff {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case !sent:
+		reason = ReasonMissing
+	case serial == "" || serial != e.Serial:
+		reason = ReasonInvalidToken
+	default:
+		return nil
+	}
+
+	if c.TokenMode == TokenModeReject {
+		return &ValidationError{Field: "token", Reason: reason}
+	}
+	flagEntry(e, TokenAttribute, reason)
+	return nil
+}
+
+// flagEntry sets attribute to reason on e
+func flagEntry(e *Entry, attribute, reason string) {
+	if e.Attributes == nil {
+		e.Attributes = make(map[string]string)
+	}
+	e.Attributes[attribute] = reason
+}
+
+// checkSignature checks the signature of r, whose body is body, if signatures are checked.
+// If r isn't signed, a ValidationError is returned in SignatureModeReject, and unsigned is true in SignatureModeFlag
+func (c *Context) checkSignature(r *http.Request, body []byte) (unsigned bool, vErr *ValidationError) {
+	if c.Signatures == nil {
+		return false, nil
+	}
+	signed, vErr := c.Signatures.Verify(r, body, time.Now())
+	if vErr != nil || signed {
+		return false, vErr
+	}
+	switch c.SignatureMode {
+	case SignatureModeReject:
+		return false, &ValidationError{Field: "signature", Reason: ReasonMissing}
+	case SignatureModeFlag:
+		return true, nil
+	}
+	return false, nil
+}
+
+// markSignature flags e if it was unsigned and signatures are checked
+func (c *Context) markSignature(e *Entry, unsigned bool) {
+	if c.Signatures == nil {
+		return
+	}
+	if unsigned {
+		flagEntry(e, SignatureAttribute, ReasonMissing)
+	}
+}
+
+// markClientCert sets ClientCertAttribute on e to the subject of r's verified client certificate, hash truncated if it's too long,
+// if client certificates are recorded
+func (c *Context) markClientCert(e *Entry, r *http.Request) {
+	if !c.ClientCerts {
+		return
+	}
+	if subject := ClientSubject(r); subject != "" {
+		flagEntry(e, ClientCertAttribute, hashTruncate(subject, maxAttributeValue))
+	}
+}
+
 // submitHandler takes an Entry and commits it to the DB
 func submitHandler(c *Context, rw http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxEntryBytes))
+	if err != nil {
+		log.Println("Error reading body:", err)
+		writeValidationErrors(rw, http.StatusBadRequest, decodeError(err))
+		return
+	}
+	unsigned, sErr := c.checkSignature(r, body)
+	if sErr != nil {
+		log.Println("Signature error:", sErr)
+		writeValidationErrors(rw, http.StatusUnauthorized, ValidationErrors{sErr})
+		return
+	}
+
 	e := &Entry{}
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(e)
+	err = json.Unmarshal(body, e)
 	if err != nil {
 		log.Println("Error decoding JSON:", err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeValidationErrors(rw, http.StatusBadRequest, decodeError(err))
 		return
 	}
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -29,47 +150,336 @@ func submitHandler(c *Context, rw http.ResponseWriter, r *http.Request) {
 
 	e.InternetIP = ip
 	e.Time = time.Now()
+	e.removeReservedAttributes()
 
+	if c.Normalizer != nil {
+		c.Normalizer.Normalize(e)
+	}
 	err = e.Validate()
 	if err != nil {
 		log.Println("Validation Error:", err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeValidationErrors(rw, http.StatusBadRequest, err.(ValidationErrors))
+		return
+	}
+	serial, sent, err := c.requestSerial(r)
+	if err != nil {
+		log.Println("Error checking device token:", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tErr := c.checkToken(e, serial, sent); tErr != nil {
+		log.Println("Device token error:", tErr)
+		writeValidationErrors(rw, http.StatusForbidden, ValidationErrors{tErr})
 		return
 	}
-	c.DB.Push(e)
+	c.markSignature(e, unsigned)
+	c.markClientCert(e, r)
+	if err = c.DB.Push(e); err != nil {
+		log.Println("Error queuing entry:", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// maxEntryBytes is the maximum size of a single entry submit request body
+const maxEntryBytes = 64 << 10
+
+// maxBatchSize is the maximum number of entries accepted by a single batch submit request
+const maxBatchSize = 10000
+
+// maxBatchBytes is the maximum size of a batch submit request body
+const maxBatchBytes = 16 << 20
+
+// Batch submit result statuses
+const (
+	StatusAccepted = "accepted"
+	StatusRejected = "rejected"
+	StatusFailed   = "failed"
+)
+
+// SubmitResult is the result of a single entry in a batch submit request.
+// Rejected entries are invalid and shouldn't be resent; failed entries couldn't be queued and can be resent later
+type SubmitResult struct {
+	Index  int              `json:"index"`
+	Status string           `json:"status"`
+	Error  string           `json:"error,omitempty"`
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// SubmitResponse is the response to a batch submit request
+type SubmitResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected int             `json:"rejected"`
+	Failed   int             `json:"failed"`
+	Results  []*SubmitResult `json:"results"`
+}
+
+// readBatch reads a JSON array or newline-delimited JSON objects from r
+func readBatch(r io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		if err = br.UnreadByte(); err != nil {
+			return nil, err
+		}
+		if c == '[' {
+			var raws []json.RawMessage
+			if err = json.NewDecoder(br).Decode(&raws); err != nil {
+				return nil, err
+			}
+			return raws, nil
+		}
+		break
+	}
+
+	var raws []json.RawMessage
+	s := bufio.NewScanner(br)
+	s.Buffer(make([]byte, 64*1024), maxBatchBytes)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		raws = append(raws, json.RawMessage(append([]byte(nil), line...)))
+	}
+	return raws, s.Err()
+}
+
+// checkTime returns a ValidationError if t is outside of the allowed window around now
+func (c *Context) checkTime(t, now time.Time) *ValidationError {
+	switch {
+	case t.IsZero():
+		return &ValidationError{Field: "time", Reason: ReasonMissing}
+	case c.MaxClockSkew > 0 && t.After(now.Add(c.MaxClockSkew)):
+		return &ValidationError{Field: "time", Reason: ReasonInFuture}
+	case c.MaxBackdate > 0 && t.Before(now.Add(-c.MaxBackdate)):
+		return &ValidationError{Field: "time", Reason: ReasonTooOld}
+	}
+	return nil
+}
+
+func (c *Context) handleSubmitBatch(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		log.Panicln("Error parsing Remote Address:", err)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		log.Println("Error reading body:", err)
+		return http.StatusBadRequest, decodeError(err)
+	}
+	unsigned, sErr := c.checkSignature(r, body)
+	if sErr != nil {
+		return http.StatusUnauthorized, ValidationErrors{sErr}
+	}
+
+	raws, err := readBatch(bytes.NewReader(body))
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		return http.StatusBadRequest, decodeError(err)
+	}
+	if len(raws) == 0 {
+		return http.StatusBadRequest, ErrEmptyBatch
+	}
+	if len(raws) > maxBatchSize {
+		return http.StatusRequestEntityTooLarge, ErrBatchTooLarge
+	}
+
+	serial, sent, err := c.requestSerial(r)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not check device token: %w", err)
+	}
+
+	now := time.Now()
+	resp := &SubmitResponse{Results: make([]*SubmitResult, len(raws))}
+	var (
+		entries []*Entry
+		valid   []*SubmitResult
+	)
+	for idx, raw := range raws {
+		resp.Results[idx] = &SubmitResult{Index: idx, Status: StatusRejected}
+		res := resp.Results[idx]
+
+		e := new(Entry)
+		if err = json.Unmarshal(raw, e); err != nil {
+			res.Errors = decodeError(err)
+		} else {
+			e.InternetIP = ip
+			e.removeReservedAttributes()
+			if c.Normalizer != nil {
+				c.Normalizer.Normalize(e)
+			}
+			if err = e.Validate(); err != nil {
+				res.Errors = err.(ValidationErrors)
+			}
+			if tErr := c.checkTime(e.Time, now); tErr != nil {
+				res.Errors = append(res.Errors, tErr)
+			}
+			if tErr := c.checkToken(e, serial, sent); tErr != nil {
+				res.Errors = append(res.Errors, tErr)
+			}
+		}
+		if len(res.Errors) != 0 {
+			res.Error = res.Errors.Error()
+			resp.Rejected++
+			continue
+		}
+		c.markSignature(e, unsigned)
+		c.markClientCert(e, r)
+
+		entries = append(entries, e)
+		valid = append(valid, res)
+	}
+
+	//queue valid entries together so they're spooled with a single sync
+	n, err := c.DB.PushBatch(entries)
+	if err != nil {
+		log.Println("Error queuing entries:", err)
+	}
+	for idx, res := range valid {
+		if idx >= n {
+			res.Status, res.Error = StatusFailed, "could not queue entry"
+			resp.Failed++
+			continue
+		}
+		res.Status = StatusAccepted
+		resp.Accepted++
+	}
+
+	return http.StatusOK, resp
+}
+
+// HandleSubmitBatch accepts a JSON array or newline-delimited JSON of Entries with client timestamps
+// and returns a SubmitResponse with the result of each entry
+func (c *Context) HandleSubmitBatch() http.Handler {
+	return jsonHandler(c.handleSubmitBatch)
 }
 
 // API errors
 var (
-	ErrAPINotEnabled      = errors.New("api not enabled")
+	ErrMissingAPIKey      = errors.New("api key is required")
 	ErrInvalidAuthHeader  = errors.New("invalid auth header")
-	ErrInvalidAPIKey      = errors.New("invalid api key")
+	ErrMissingScope       = errors.New("api key does not have the required scope")
 	ErrInvalidSerialCount = errors.New("invalid serial count")
+	ErrEmptyBatch         = errors.New("no entries submitted")
+	ErrBatchTooLarge      = fmt.Errorf("more than %d entries submitted", maxBatchSize)
+	ErrMissingKey         = errors.New("key is required")
+	ErrMissingSerial      = errors.New("serial is required")
+	ErrInvalidDays        = errors.New("days must be a positive integer")
+	ErrInvalidFormat      = errors.New("format must be json or csv")
 )
 
-func (c *Context) handleQueryLastUser(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
-	if c.APIKey == "" {
-		return http.StatusNotFound, ErrAPINotEnabled
+// legacyKey is the API key for Context.APIKey
+var legacyKey = &APIKey{Name: "CHRONICLE_APIKEY", Scopes: []Scope{ScopeQuery, ScopeExport}}
+
+// authorize checks that r's API key grants scope, returning the key (nil for anonymous requests), or the status and error if it doesn't
+func (c *Context) authorize(r *http.Request, scope Scope) (*APIKey, int, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		for _, s := range c.AnonymousScopes {
+			if s == scope {
+				return nil, http.StatusOK, nil
+			}
+		}
+		return nil, http.StatusUnauthorized, ErrMissingAPIKey
 	}
-	header := strings.Split(r.Header.Get("Authorization"), " ")
+
+	header := strings.Split(auth, " ")
 	if len(header) != 2 || header[0] != "Bearer" || len(header[1]) == 0 {
-		return http.StatusUnauthorized, ErrInvalidAuthHeader
+		return nil, http.StatusUnauthorized, ErrInvalidAuthHeader
+	}
+
+	var key *APIKey
+	switch {
+	case c.APIKey != "" && subtle.ConstantTimeEq(int32(len(c.APIKey)), int32(len([]byte(header[1])))) == 1 &&
+		subtle.ConstantTimeCompare([]byte(c.APIKey), []byte(header[1])) == 1:
+		key = legacyKey
+	case c.Keys == nil:
+		return nil, http.StatusUnauthorized, ErrInvalidAPIKey
+	default:
+		var err error
+		if key, err = c.Keys.Authenticate(header[1]); err != nil {
+			if errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrExpiredAPIKey) || errors.Is(err, ErrRevokedAPIKey) {
+				return nil, http.StatusUnauthorized, err
+			}
+			return nil, http.StatusInternalServerError, fmt.Errorf("could not authenticate: %w", err)
+		}
+	}
+
+	if !key.HasScope(scope) {
+		return nil, http.StatusForbidden, ErrMissingScope
 	}
+	return key, http.StatusOK, nil
+}
+
+type contextKey int
+
+const apiKeyContextKey contextKey = iota
+
+// RequestKey returns the API key that authorized r, or nil if r was anonymous
+func RequestKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+// Authorize returns an http.Handler that only calls h if the request's Bearer API key grants scope.
+// Requests without an API key are allowed if scope is in c.AnonymousScopes
+func (c *Context) Authorize(scope Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, status, err := c.authorize(r, scope)
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			jsonHandler(func(http.ResponseWriter, *http.Request) (int, interface{}) { return status, err }).ServeHTTP(w, r)
+			return
+		}
+		if key != nil {
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// LastUserQuery is a query for the last user of devices.
+// A JSON array of serials is also accepted
+type LastUserQuery struct {
+	Serials []string `json:"serials"`
+	// Exclude, if not nil, replaces the server's excluded accounts
+	Exclude *Exclusion `json:"exclude,omitempty"`
+}
 
-	if subtle.ConstantTimeEq(int32(len(c.APIKey)), int32(len([]byte(header[1])))) != 1 ||
-		subtle.ConstantTimeCompare([]byte(c.APIKey), []byte(header[1])) != 1 {
-		return http.StatusUnauthorized, ErrInvalidAPIKey
+// UnmarshalJSON implements json.Unmarshaler
+func (q *LastUserQuery) UnmarshalJSON(buf []byte) error {
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(buf, &(q.Serials))
 	}
+	type query LastUserQuery
+	return json.Unmarshal(buf, (*query)(q))
+}
 
-	var serials []string
-	if err := json.NewDecoder(r.Body).Decode(&serials); err != nil {
+func (c *Context) handleQueryLastUser(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(LastUserQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
 		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
 	}
-	if len(serials) == 0 {
+	if len(q.Serials) == 0 {
 		return http.StatusBadRequest, ErrInvalidSerialCount
 	}
+	if q.Exclude == nil {
+		q.Exclude = c.Exclude
+	}
 
-	entries, err := c.DB.QueryLastUser(serials)
+	entries, err := c.DB.QueryLastUser(q.Serials, q.Exclude)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
 	}
@@ -79,11 +489,268 @@ func (c *Context) handleQueryLastUser(_ http.ResponseWriter, r *http.Request) (i
 
 // HandleQueryLastUser returns the latest information for the submitted serials
 func (c *Context) HandleQueryLastUser() http.Handler {
+	return jsonHandler(c.handleQueryLastUser)
+}
+
+func (c *Context) handleQueryAttribute(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(AttributeQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
+	}
+	if q.Key == "" {
+		return http.StatusBadRequest, ErrMissingKey
+	}
+	if q.Exclude == nil {
+		q.Exclude = c.Exclude
+	}
+
+	entries, err := c.DB.QueryAttribute(q)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+
+	return http.StatusOK, entries
+}
+
+// HandleQueryAttribute returns the latest information for devices that submitted an attribute with the queried key and optional value
+func (c *Context) HandleQueryAttribute() http.Handler {
+	return jsonHandler(c.handleQueryAttribute)
+}
+
+func (c *Context) handleQueryHistory(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(HistoryQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
+	}
+	if q.Serial == "" {
+		return http.StatusBadRequest, ErrMissingSerial
+	}
+
+	page, err := c.DB.QueryHistory(q)
+	if errors.Is(err, ErrInvalidCursor) {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+
+	return http.StatusOK, page
+}
+
+// HandleQueryHistory returns a page of the entries logged by the queried serial, oldest first
+func (c *Context) HandleQueryHistory() http.Handler {
+	return jsonHandler(c.handleQueryHistory)
+}
+
+func (c *Context) handleQueryUser(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(UserQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
+	}
+
+	devices, err := c.DB.QueryUser(q)
+	if errors.Is(err, ErrMissingUser) {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+
+	return http.StatusOK, devices
+}
+
+// HandleQueryUser returns the devices the queried user has logged in from with first and last seen times and check-in counts
+func (c *Context) HandleQueryUser() http.Handler {
+	return jsonHandler(c.handleQueryUser)
+}
+
+func (c *Context) handleQuerySessions(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(SessionQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
+	}
+
+	sessions, err := c.DB.QuerySessions(q)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+
+	return http.StatusOK, sessions
+}
+
+// HandleQuerySessions returns the sessions matching the queried serial, username, and time range, most recently started first
+func (c *Context) HandleQuerySessions() http.Handler {
+	return jsonHandler(c.handleQuerySessions)
+}
+
+// EnrollRequest is a request to exchange a one-time enrollment secret for a device token
+type EnrollRequest struct {
+	Secret string `json:"secret"`
+	Serial string `json:"serial"`
+}
+
+// EnrollResponse is the response to an EnrollRequest. Token must be sent in the X-Device-Token header of submit requests
+type EnrollResponse struct {
+	Serial string `json:"serial"`
+	Token  string `json:"token"`
+}
+
+func (c *Context) handleEnroll(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	req := new(EnrollRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return http.StatusBadRequest, decodeError(err)
+	}
+	if c.Normalizer != nil && c.Normalizer.TrimSpace {
+		req.Serial = strings.TrimSpace(req.Serial)
+	}
+
+	var errs ValidationErrors
+	if req.Secret == "" {
+		errs = append(errs, &ValidationError{Field: "secret", Reason: ReasonMissing})
+	}
+	if req.Serial == "" {
+		errs = append(errs, &ValidationError{Field: "serial", Reason: ReasonMissing})
+	} else if len(req.Serial) > 32 {
+		errs = append(errs, &ValidationError{Field: "serial", Limit: 32, Reason: ReasonTooLong})
+	}
+	if len(errs) != 0 {
+		return http.StatusBadRequest, errs
+	}
+
+	token, err := c.DB.Enroll(req.Secret, req.Serial)
+	if errors.Is(err, ErrInvalidSecret) {
+		return http.StatusForbidden, err
+	}
+	if errors.Is(err, ErrEnrolled) {
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not enroll device: %w", err)
+	}
+
+	return http.StatusOK, &EnrollResponse{Serial: req.Serial, Token: token}
+}
+
+// HandleEnroll exchanges a one-time enrollment secret for a device token for the submitted serial
+func (c *Context) HandleEnroll() http.Handler {
+	return jsonHandler(c.handleEnroll)
+}
+
+// defaultStaleDays is the number of days without an entry before a device is reported as stale if not given
+const defaultStaleDays = 30
+
+func (c *Context) handleStaleReport(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	days := defaultStaleDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		d, err := strconv.Atoi(s)
+		if err != nil || d <= 0 {
+			return http.StatusBadRequest, ErrInvalidDays
+		}
+		days = d
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		return http.StatusBadRequest, ErrInvalidFormat
+	}
+
+	report, err := c.DB.QueryStale(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+
+	if format == "csv" {
+		return http.StatusOK, csvResponse{report}
+	}
+	return http.StatusOK, report
+}
+
+// HandleStaleReport returns the devices that haven't logged an entry in the last days (default: 30), grouped by client identifier, as JSON or CSV
+func (c *Context) HandleStaleReport() http.Handler {
+	return jsonHandler(c.handleStaleReport)
+}
+
+// maxLookupTolerance is the largest tolerance allowed by an IPQuery
+const maxLookupTolerance = 24 * time.Hour
+
+// IPQuery is a query for the identities using an address at a time
+type IPQuery struct {
+	IP         string    `json:"ip,omitempty"`
+	InternetIP string    `json:"internet_ip,omitempty"`
+	Time       time.Time `json:"time"`
+	// Tolerance is the number of seconds before and after Time to search; default: Context.LookupTolerance
+	Tolerance int `json:"tolerance,omitempty"`
+}
+
+func (c *Context) handleQueryIP(_ http.ResponseWriter, r *http.Request) (int, interface{}) {
+	q := new(IPQuery)
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not parse body: %w", err)
+	}
+	if q.Time.IsZero() {
+		return http.StatusBadRequest, ValidationErrors{{Field: "time", Reason: ReasonMissing}}
+	}
+
+	tolerance := c.LookupTolerance
+	if q.Tolerance > 0 {
+		tolerance = time.Duration(q.Tolerance) * time.Second
+	}
+	if tolerance <= 0 {
+		tolerance = time.Hour
+	}
+	if tolerance > maxLookupTolerance {
+		tolerance = maxLookupTolerance
+	}
+
+	matches, err := c.DB.QueryIP(q.IP, q.InternetIP, q.Time, tolerance)
+	var vErrs ValidationErrors
+	if errors.As(err, &vErrs) || errors.Is(err, ErrMissingAddress) {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("could not query database: %w", err)
+	}
+	if matches == nil {
+		matches = []*IPMatch{}
+	}
+
+	return http.StatusOK, matches
+}
+
+// HandleQueryIP returns the identities that used the queried address within the tolerance window of the queried time
+func (c *Context) HandleQueryIP() http.Handler {
+	return jsonHandler(c.handleQueryIP)
+}
+
+// csvResponse is a response body written as CSV instead of JSON
+type csvResponse struct {
+	body interface {
+		WriteCSV(io.Writer) error
+	}
+}
+
+// jsonHandler returns an http.Handler that writes the status and JSON encoded body returned by fn.
+// If body is a csvResponse, it's written as CSV instead.
+// If body is a ValidationErrors, an ErrorResponse is returned.
+// If body is any other error, it's logged and only the status is returned
+func jsonHandler(fn func(http.ResponseWriter, *http.Request) (int, interface{})) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status, body := c.handleQueryLastUser(w, r)
+		status, body := fn(w, r)
+		if csv, ok := body.(csvResponse); ok {
+			w.Header().Set("Content-Type", "text/csv")
+			w.WriteHeader(status)
+			if err := csv.body.WriteCSV(w); err != nil {
+				log.Println("couldn't write body:", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
 
-		if err, ok := body.(error); ok {
+		if errs, ok := body.(ValidationErrors); ok {
+			body = &ErrorResponse{Status: status, Errors: errs}
+		} else if err, ok := body.(error); ok {
 			log.Println("api error:", err)
 			body = map[string]interface{}{"status": status}
 		}
@@ -0,0 +1,421 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// submitBatch posts body to a batch submit handler and returns the decoded response
+func submitBatch(t *testing.T, c *Context, body string) (int, *SubmitResponse) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/v2/submit", strings.NewReader(body))
+	r.RemoteAddr = "1.2.3.4:5678"
+	w := httptest.NewRecorder()
+	c.HandleSubmitBatch().ServeHTTP(w, r)
+
+	resp := new(SubmitResponse)
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatal("could not decode response:", err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestSubmitBatch(t *testing.T) {
+	db := newTestDB(t)
+	c := &Context{DB: db, MaxClockSkew: time.Minute, MaxBackdate: 24 * time.Hour}
+	now := time.Now()
+
+	entry := func(serial string, t time.Time) string {
+		buf, _ := json.Marshal(&Entry{Username: "alice", Serial: serial, IP: "10.0.0.1", Time: t})
+		return string(buf)
+	}
+
+	for _, test := range []struct {
+		name string
+		body string
+	}{
+		{"array", "[" + strings.Join([]string{
+			entry("SERIAL1", now.Add(-time.Hour)),
+			entry("SERIAL2", now.Add(time.Hour)),
+			entry("SERIAL3", now.Add(-48*time.Hour)),
+			`{"serial": 1}`,
+			entry(strings.Repeat("S", 33), now),
+			`{"username": "alice", "serial": "SERIAL4"}`,
+		}, ",") + "]"},
+		{"ndjson", strings.Join([]string{
+			entry("SERIAL1", now.Add(-time.Hour)),
+			entry("SERIAL2", now.Add(time.Hour)),
+			entry("SERIAL3", now.Add(-48*time.Hour)),
+			`{"serial": `,
+			"",
+			entry(strings.Repeat("S", 33), now),
+			`{"username": "alice", "serial": "SERIAL4"}`,
+		}, "\n") + "\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			code, resp := submitBatch(t, c, test.body)
+			if code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+			}
+			if resp.Accepted != 1 || resp.Rejected != 5 || len(resp.Results) != 6 {
+				t.Fatalf("unexpected response: %#v", resp)
+			}
+			for idx, res := range resp.Results {
+				if res.Index != idx {
+					t.Errorf("expected index %d, got %d", idx, res.Index)
+				}
+			}
+			if resp.Results[0].Status != StatusAccepted {
+				t.Errorf("expected first entry to be accepted, got %#v", resp.Results[0])
+			}
+			for idx, expected := range map[int]ValidationError{
+				1: {Field: "time", Reason: ReasonInFuture},
+				2: {Field: "time", Reason: ReasonTooOld},
+				4: {Field: "serial", Limit: 32, Reason: ReasonTooLong},
+				5: {Field: "time", Reason: ReasonMissing},
+			} {
+				if errs := resp.Results[idx].Errors; len(errs) != 1 || *errs[0] != expected {
+					t.Errorf("%d: expected %v, got %v", idx, &expected, errs)
+				}
+			}
+			if errs := resp.Results[3].Errors; len(errs) != 1 || (errs[0].Reason != ReasonInvalidType && errs[0].Reason != ReasonInvalidJSON) {
+				t.Errorf("3: expected decode error, got %v", errs)
+			}
+		})
+	}
+
+	waitForRows(t, db, "log", 2)
+
+	var tm time.Time
+	if err := db.DB.QueryRow("SELECT time FROM log LIMIT 1").Scan(&tm); err != nil {
+		t.Fatal("could not query log:", err)
+	}
+	if !tm.Equal(now.Add(-time.Hour)) {
+		t.Errorf("expected client time %v, got %v", now.Add(-time.Hour), tm)
+	}
+
+	if code, _ := submitBatch(t, c, "  "); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for empty body, got %d", http.StatusBadRequest, code)
+	}
+	if code, _ := submitBatch(t, c, "[{]"); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid array, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	c := &Context{DB: newTestDB(t)}
+
+	for _, test := range []struct {
+		body     string
+		expected ValidationErrors
+	}{
+		{`{"username": "alice", "serial": "` + strings.Repeat("S", 33) + `", "ip": "localhost"}`, ValidationErrors{
+			{Field: "serial", Limit: 32, Reason: ReasonTooLong},
+			{Field: "ip", Reason: ReasonInvalidAddress},
+		}},
+		{`{"username": 1}`, ValidationErrors{{Field: "username", Reason: ReasonInvalidType}}},
+		{`{"username": `, ValidationErrors{{Reason: ReasonInvalidJSON}}},
+		{`{"username": "` + strings.Repeat("a", maxEntryBytes) + `"}`, ValidationErrors{{Reason: ReasonInvalidJSON}}},
+	} {
+		r := httptest.NewRequest("POST", "/api/v1.1/submit", strings.NewReader(test.body))
+		r.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		SubmitHandler(c).ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", test.body, http.StatusBadRequest, w.Code)
+			continue
+		}
+		resp := new(ErrorResponse)
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatal("could not decode response:", err)
+		}
+		if len(resp.Errors) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.body, test.expected, resp.Errors)
+			continue
+		}
+		for idx := range test.expected {
+			if *resp.Errors[idx] != *test.expected[idx] {
+				t.Errorf("%s: expected %#v, got %#v", test.body, test.expected[idx], resp.Errors[idx])
+			}
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	db := newTestDB(t)
+	query, _, err := db.CreateAPIKey("query", []Scope{ScopeQuery}, time.Time{})
+	if err != nil {
+		t.Fatal("could not create key:", err)
+	}
+	admin, _, err := db.CreateAPIKey("admin", []Scope{ScopeAdmin}, time.Time{})
+	if err != nil {
+		t.Fatal("could not create key:", err)
+	}
+
+	c := &Context{DB: db, Keys: NewKeyStore(db, 0), APIKey: "legacy", AnonymousScopes: []Scope{ScopeSubmit}}
+
+	var name string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = ""
+		if key := RequestKey(r); key != nil {
+			name = key.Name
+		}
+	})
+
+	for _, test := range []struct {
+		scope  Scope
+		auth   string
+		status int
+		name   string
+	}{
+		{ScopeSubmit, "", http.StatusOK, ""},
+		{ScopeQuery, "", http.StatusUnauthorized, ""},
+		{ScopeQuery, "Bearer " + query, http.StatusOK, "query"},
+		{ScopeSubmit, "Bearer " + query, http.StatusForbidden, ""},
+		{ScopeExport, "Bearer " + admin, http.StatusOK, "admin"},
+		{ScopeExport, "Bearer legacy", http.StatusOK, "CHRONICLE_APIKEY"},
+		{ScopeAdmin, "Bearer legacy", http.StatusForbidden, ""},
+		{ScopeSubmit, "Bearer wrong", http.StatusUnauthorized, ""},
+		{ScopeQuery, "Basic " + query, http.StatusUnauthorized, ""},
+	} {
+		name = ""
+		r := httptest.NewRequest("POST", "/", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		c.Authorize(test.scope, h).ServeHTTP(w, r)
+		if w.Code != test.status || name != test.name {
+			t.Errorf("%s with %q: expected %d (%q), got %d (%q)", test.scope, test.auth, test.status, test.name, w.Code, name)
+		}
+	}
+}
+
+func TestDeviceTokens(t *testing.T) {
+	db := newTestDB(t)
+	c := &Context{DB: db, Tokens: NewTokenStore(db, 0), TokenMode: TokenModeReject}
+
+	secret, err := db.CreateEnrollmentSecret(time.Time{})
+	if err != nil {
+		t.Fatal("could not create secret:", err)
+	}
+
+	enroll := func() (int, *EnrollResponse) {
+		r := httptest.NewRequest("POST", "/api/v2/enroll", strings.NewReader(`{"secret": "`+secret+`", "serial": "SERIAL1"}`))
+		w := httptest.NewRecorder()
+		c.HandleEnroll().ServeHTTP(w, r)
+		resp := new(EnrollResponse)
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatal("could not decode response:", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	code, resp := enroll()
+	if code != http.StatusOK || resp.Serial != "SERIAL1" || !strings.HasPrefix(resp.Token, tokenPrefix) {
+		t.Fatalf("unexpected enroll response: %d, %#v", code, resp)
+	}
+	if code, _ = enroll(); code != http.StatusForbidden {
+		t.Errorf("expected reused secret to be forbidden, got %d", code)
+	}
+	if secret, err = db.CreateEnrollmentSecret(time.Time{}); err != nil {
+		t.Fatal("could not create secret:", err)
+	}
+	if code, _ = enroll(); code != http.StatusConflict {
+		t.Errorf("expected enrolling an enrolled serial to conflict, got %d", code)
+	}
+
+	submit := func(serial, token string) int {
+		r := httptest.NewRequest("POST", "/api/v1.1/submit", strings.NewReader(`{"username": "alice", "serial": "`+serial+`", "ip": "10.0.0.1"}`))
+		r.RemoteAddr = "1.2.3.4:5678"
+		if token != "" {
+			r.Header.Set(DeviceTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		SubmitHandler(c).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, test := range []struct {
+		serial, token string
+		status        int
+	}{
+		{"SERIAL1", resp.Token, http.StatusOK},
+		{"SERIAL2", resp.Token, http.StatusForbidden},
+		{"SERIAL1", "", http.StatusForbidden},
+		{"SERIAL1", "dev_wrong", http.StatusForbidden},
+	} {
+		if code = submit(test.serial, test.token); code != test.status {
+			t.Errorf("%s with token %q: expected %d, got %d", test.serial, test.token, test.status, code)
+		}
+	}
+	waitForRows(t, db, "log", 1)
+
+	c.TokenMode = TokenModeFlag
+	if code = submit("SERIAL2", resp.Token); code != http.StatusOK {
+		t.Errorf("expected flagged entry to be accepted, got %d", code)
+	}
+	waitForRows(t, db, "log", 2)
+	waitForRows(t, db, "attribute WHERE name='chronicle.token' AND value='invalid_token'", 1)
+}
+
+func TestReservedAttributes(t *testing.T) {
+	db := newTestDB(t)
+	c := &Context{DB: db}
+
+	r := httptest.NewRequest("POST", "/api/v1.1/submit", strings.NewReader(`{"username": "alice", "serial": "SERIAL1", "ip": "10.0.0.1", "attributes": {"lab": "Room 101", "chronicle.token": "valid", "chronicle.signature": "valid", "chronicle.client_cert": "CN=spoofed"}}`))
+	r.RemoteAddr = "1.2.3.4:5678"
+	w := httptest.NewRecorder()
+	SubmitHandler(c).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	//reserved attributes don't count against maxAttributes
+	attrs := map[string]string{"chronicle.token": "valid", "chronicle.signature": "valid", "chronicle.client_cert": "CN=spoofed"}
+	for idx := 0; idx < maxAttributes; idx++ {
+		attrs["key"+strconv.Itoa(idx)] = "value"
+	}
+	buf, _ := json.Marshal(&Entry{Username: "bob", Serial: "SERIAL2", IP: "10.0.0.2", Time: time.Now(), Attributes: attrs})
+	if code, resp := submitBatch(t, c, string(buf)); code != http.StatusOK || resp.Accepted != 1 {
+		t.Fatalf("unexpected response: %d, %#v", code, resp)
+	}
+
+	waitForRows(t, db, "log", 2)
+	waitForRows(t, db, "attribute WHERE name LIKE 'chronicle.%'", 0)
+}
+
+func TestBackdatedBatch(t *testing.T) {
+	db := newTestDB(t)
+	c := &Context{DB: db, MaxClockSkew: time.Minute}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	batch := func(entries ...*Entry) {
+		t.Helper()
+		lines := make([]string, len(entries))
+		for idx, e := range entries {
+			buf, _ := json.Marshal(e)
+			lines[idx] = string(buf)
+		}
+		if code, resp := submitBatch(t, c, strings.Join(lines, "\n")); code != http.StatusOK || resp.Accepted != len(entries) {
+			t.Fatalf("unexpected response: %d, %#v", code, resp)
+		}
+	}
+	lab := map[string]string{"lab": "Room 101"}
+
+	batch(
+		&Entry{Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", Time: now.Add(-time.Minute), Attributes: lab},
+		&Entry{Username: "carol", Serial: "SERIAL2", IP: "10.0.0.2", Time: now.AddDate(0, 0, -40)},
+	)
+	waitForRows(t, db, "log", 2)
+
+	//an offline client uploads older entries after the newer ones were written
+	batch(
+		&Entry{Username: "bob", Serial: "SERIAL1", IP: "10.0.0.1", Time: now.Add(-2 * time.Hour), Attributes: lab},
+		&Entry{Username: "dave", Serial: "SERIAL2", IP: "10.0.0.2", Time: now.AddDate(0, 0, -45)},
+	)
+	waitForRows(t, db, "log", 4)
+
+	entries, err := db.QueryLastUser([]string{"SERIAL1"}, nil)
+	if err != nil {
+		t.Fatal("could not query last user:", err)
+	}
+	if len(entries) != 1 || entries[0].Username != "alice" {
+		t.Errorf("expected alice to be the last user, got %#v", entries)
+	}
+
+	if entries, err = db.QueryAttribute(&AttributeQuery{Key: "lab"}); err != nil {
+		t.Fatal("could not query attribute:", err)
+	}
+	if len(entries) != 1 || entries[0].Username != "alice" {
+		t.Errorf("expected alice's entry, got %#v", entries)
+	}
+
+	report, err := db.QueryStale(now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal("could not query stale devices:", err)
+	}
+	if len(report) != 1 || len(report[0].Devices) != 1 {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+	if d := report[0].Devices[0]; d.Serial != "SERIAL2" || d.Username != "carol" || !d.LastSeen.Equal(now.AddDate(0, 0, -40)) {
+		t.Errorf("expected carol's entry from 40 days ago, got %#v", d)
+	}
+}
+
+func TestSignedSubmit(t *testing.T) {
+	db := newTestDB(t)
+	c := &Context{DB: db, Signatures: NewVerifier(map[string]string{DefaultSigningKey: "secret"}, 0), SignatureMode: SignatureModeReject}
+
+	submit := func(serial string, sign func(r *http.Request, body []byte)) int {
+		body := []byte(`{"username": "alice", "serial": "` + serial + `", "ip": "10.0.0.1", "attributes": {"chronicle.signature": "ok"}}`)
+		r := httptest.NewRequest("POST", "/api/v1.1/submit", bytes.NewReader(body))
+		r.RemoteAddr = "1.2.3.4:5678"
+		if sign != nil {
+			sign(r, body)
+		}
+		w := httptest.NewRecorder()
+		SubmitHandler(c).ServeHTTP(w, r)
+		return w.Code
+	}
+	signAt := func(ts int64) func(r *http.Request, body []byte) {
+		return func(r *http.Request, body []byte) {
+			r.Header.Set(SignatureTimestampHeader, strconv.FormatInt(ts, 10))
+			r.Header.Set(SignatureHeader, Sign([]byte("secret"), ts, body))
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, test := range []struct {
+		name   string
+		sign   func(r *http.Request, body []byte)
+		status int
+	}{
+		{"signed", signAt(now), http.StatusOK},
+		{"replayed", signAt(now), http.StatusUnauthorized},
+		{"unsigned", nil, http.StatusUnauthorized},
+		{"expired", signAt(now - 3600), http.StatusUnauthorized},
+	} {
+		if code := submit("SERIAL1", test.sign); code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, code)
+		}
+	}
+	waitForRows(t, db, "log", 1)
+
+	c.SignatureMode = SignatureModeFlag
+	if code := submit("SERIAL2", nil); code != http.StatusOK {
+		t.Errorf("expected unsigned entry to be accepted, got %d", code)
+	}
+	waitForRows(t, db, "log", 2)
+	waitForRows(t, db, "attribute WHERE name='chronicle.signature' AND value='missing'", 1)
+	waitForRows(t, db, "attribute WHERE name='chronicle.signature' AND value='ok'", 0)
+}
+
+func TestLastUserQueryUnmarshal(t *testing.T) {
+	q := new(LastUserQuery)
+	if err := json.Unmarshal([]byte(` ["SERIAL1", "SERIAL2"]`), q); err != nil {
+		t.Fatal("could not unmarshal array:", err)
+	}
+	if len(q.Serials) != 2 || q.Exclude != nil {
+		t.Errorf("unexpected query: %#v", q)
+	}
+
+	q = new(LastUserQuery)
+	if err := json.Unmarshal([]byte(`{"serials": ["SERIAL1"], "exclude": {"prefixes": ["svc_"]}}`), q); err != nil {
+		t.Fatal("could not unmarshal object:", err)
+	}
+	if len(q.Serials) != 1 || q.Exclude == nil || len(q.Exclude.Prefixes) != 1 {
+		t.Errorf("unexpected query: %#v", q)
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// secretPrefix and tokenPrefix are prepended to generated enrollment secrets and device tokens
+const (
+	secretPrefix = "enr_"
+	tokenPrefix  = "dev_"
+)
+
+// TokenMode is what's done with submitted entries without a valid device token for their serial
+type TokenMode string
+
+// Device token modes
+const (
+	// TokenModeOff doesn't check device tokens
+	TokenModeOff TokenMode = "off"
+	// TokenModeFlag accepts entries, setting TokenAttribute to the reason the token isn't valid
+	TokenModeFlag TokenMode = "flag"
+	// TokenModeReject rejects entries
+	TokenModeReject TokenMode = "reject"
+)
+
+// ParseTokenMode parses a TokenMode. An empty string is TokenModeOff
+func ParseTokenMode(s string) (TokenMode, error) {
+	switch m := TokenMode(s); m {
+	case "":
+		return TokenModeOff, nil
+	case TokenModeOff, TokenModeFlag, TokenModeReject:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown device token mode: %s", s)
+}
+
+// DeviceTokenHeader is the request header submit requests send their device token in
+const DeviceTokenHeader = "X-Device-Token"
+
+// TokenAttribute is the attribute set on entries flagged by TokenModeFlag: missing or invalid_token.
+// Submitted values for it are always removed
+const TokenAttribute = "chronicle.token"
+
+// Enrollment errors
+var (
+	ErrInvalidSecret = errors.New("invalid, used, or expired enrollment secret")
+	ErrUnknownDevice = errors.New("no device token for that serial")
+	ErrEnrolled      = errors.New("serial is already enrolled")
+)
+
+// CreateEnrollmentSecret generates and stores a new one-time enrollment secret and returns it.
+// Only its hash is stored, so the secret can't be retrieved later. If expires is zero, the secret doesn't expire
+func (db *DB) CreateEnrollmentSecret(expires time.Time) (string, error) {
+	secret, err := newSecret(secretPrefix)
+	if err != nil {
+		return "", fmt.Errorf("could not generate secret: %w", err)
+	}
+
+	var expiresAt interface{}
+	if !expires.IsZero() {
+		expiresAt = expires.UTC()
+	}
+	if _, err = db.DB.Exec(db.dialect.rebind("INSERT INTO enrollment_secret(secret_hash, created_at, expires_at) VALUES(?, ?, ?)"),
+		hashKey(secret), time.Now().UTC(), expiresAt); err != nil {
+		return "", fmt.Errorf("could not insert enrollment secret: %w", err)
+	}
+	return secret, nil
+}
+
+// Enroll uses up the enrollment secret and returns a new device token for serial.
+// ErrInvalidSecret is returned if the secret doesn't exist, was already used, or is expired.
+// ErrEnrolled is returned without using up the secret if serial already has a token, so a leaked secret can't take over an enrolled device;
+// its token must be revoked with RevokeDeviceToken before it can be enrolled again
+func (db *DB) Enroll(secret, serial string) (string, error) {
+	token, err := newSecret(tokenPrefix)
+	if err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		id      int
+		expires sql.NullTime
+	)
+	err = tx.QueryRow(db.dialect.rebind("SELECT id, expires_at FROM enrollment_secret WHERE secret_hash=? AND used_at IS NULL"), hashKey(secret)).Scan(&id, &expires)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidSecret
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not query enrollment secret: %w", err)
+	}
+	now := time.Now().UTC()
+	if expires.Valid && !now.Before(expires.Time) {
+		return "", ErrInvalidSecret
+	}
+
+	var enrolled int
+	if err = tx.QueryRow(db.dialect.rebind("SELECT COUNT(*) FROM device_token WHERE serial=?"), serial).Scan(&enrolled); err != nil {
+		return "", fmt.Errorf("could not query device token: %w", err)
+	}
+	if enrolled != 0 {
+		return "", ErrEnrolled
+	}
+
+	res, err := tx.Exec(db.dialect.rebind("UPDATE enrollment_secret SET used_at=?, serial=? WHERE id=? AND used_at IS NULL"), now, serial, id)
+	if err != nil {
+		return "", fmt.Errorf("could not update enrollment secret: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return "", ErrInvalidSecret
+	}
+
+	//serial is unique, so this also fails if serial was enrolled concurrently
+	if _, err = tx.Exec(db.dialect.rebind("INSERT INTO device_token(serial, token_hash, created_at) VALUES(?, ?, ?)"), serial, hashKey(token), now); err != nil {
+		return "", fmt.Errorf("could not insert device token: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("could not commit: %w", err)
+	}
+	return token, nil
+}
+
+// RevokeDeviceToken deletes the device token for serial. The device must be enrolled again to get a new token
+func (db *DB) RevokeDeviceToken(serial string) error {
+	res, err := db.DB.Exec(db.dialect.rebind("DELETE FROM device_token WHERE serial=?"), serial)
+	if err != nil {
+		return fmt.Errorf("could not delete device token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUnknownDevice
+	}
+	return nil
+}
+
+// tokenSerial returns the serial for the device token with the given hash, or an empty string if it doesn't exist
+func (db *DB) tokenSerial(hash string) (string, error) {
+	var serial string
+	err := db.DB.QueryRow(db.dialect.rebind("SELECT serial FROM device_token WHERE token_hash=?"), hash).Scan(&serial)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not query device token: %w", err)
+	}
+	return serial, nil
+}
+
+type cachedToken struct {
+	serial  string
+	expires time.Time
+}
+
+// TokenStore looks up the serials of device tokens stored in the database.
+// Found tokens are cached, so revoking a token can take up to the cache TTL to take effect
+type TokenStore struct {
+	db  *DB
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedToken
+}
+
+// NewTokenStore returns a new TokenStore that caches tokens for ttl; default: 1 minute
+func NewTokenStore(db *DB, ttl time.Duration) *TokenStore {
+	if ttl <= 0 {
+		ttl = defaultKeyTTL
+	}
+	return &TokenStore{db: db, ttl: ttl, cache: make(map[string]*cachedToken)}
+}
+
+// Serial returns the serial token was issued to, or an empty string if token isn't valid
+func (s *TokenStore) Serial(token string) (string, error) {
+	hash := hashKey(token)
+	now := time.Now()
+
+	s.mu.Lock()
+	c, ok := s.cache[hash]
+	if ok && now.After(c.expires) {
+		delete(s.cache, hash)
+		ok = false
+	}
+	s.mu.Unlock()
+	if ok {
+		return c.serial, nil
+	}
+
+	serial, err := s.db.tokenSerial(hash)
+	if err != nil || serial == "" {
+		return "", err
+	}
+	s.mu.Lock()
+	s.cache[hash] = &cachedToken{serial: serial, expires: now.Add(s.ttl)}
+	s.mu.Unlock()
+	return serial, nil
+}
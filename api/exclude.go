@@ -0,0 +1,85 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UIDRange is an inclusive range of UIDs
+type UIDRange struct {
+	Min uint32 `json:"min"`
+	Max uint32 `json:"max"`
+}
+
+// ParseUIDRanges parses a comma separated list of UIDs and inclusive UID ranges, e.g. 0-499,65534
+func ParseUIDRanges(s string) ([]UIDRange, error) {
+	var ranges []UIDRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		min, max := part, part
+		if idx := strings.Index(part, "-"); idx != -1 {
+			min, max = strings.TrimSpace(part[:idx]), strings.TrimSpace(part[idx+1:])
+		}
+		lo, err := strconv.ParseUint(min, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID range %q: %w", part, err)
+		}
+		hi, err := strconv.ParseUint(max, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID range %q: %w", part, err)
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("invalid UID range %q: start is greater than end", part)
+		}
+		ranges = append(ranges, UIDRange{Min: uint32(lo), Max: uint32(hi)})
+	}
+	return ranges, nil
+}
+
+// Exclusion is a set of accounts left out of last user queries.
+// Entries with an empty username are always excluded
+type Exclusion struct {
+	// Usernames are excluded if they match exactly
+	Usernames []string `json:"usernames,omitempty"`
+	// Prefixes are excluded if the username starts with any of them
+	Prefixes []string `json:"prefixes,omitempty"`
+	// UIDRanges are excluded if the UID is within any of them
+	UIDRanges []UIDRange `json:"uid_ranges,omitempty"`
+}
+
+// DefaultExclusion is used by last user queries if no Exclusion is given
+var DefaultExclusion = &Exclusion{Usernames: []string{"administrator", "root"}}
+
+// filter returns a where clause condition, and its parameters, that's false for excluded accounts
+func (x *Exclusion) filter() (string, []interface{}) {
+	if x == nil {
+		x = DefaultExclusion
+	}
+
+	filters := []string{`"user".username <> ''`}
+	var params []interface{}
+
+	if len(x.Usernames) > 0 {
+		filters = append(filters, fmt.Sprintf(`"user".username not in (%s)`, placeholders(len(x.Usernames))))
+		for _, u := range x.Usernames {
+			params = append(params, u)
+		}
+	}
+	for _, p := range x.Prefixes {
+		if p == "" {
+			continue
+		}
+		filters = append(filters, `"user".username not like ? escape '!'`)
+		params = append(params, likeEscaper.Replace(p)+"%")
+	}
+	for _, r := range x.UIDRanges {
+		filters = append(filters, `"user".uid not between ? and ?`)
+		params = append(params, r.Min, r.Max)
+	}
+
+	return strings.Join(filters, " and "), params
+}
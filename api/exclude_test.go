@@ -0,0 +1,26 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUIDRanges(t *testing.T) {
+	ranges, err := ParseUIDRanges("0-499, 65534,1000 - 1010,")
+	if err != nil {
+		t.Fatal("could not parse:", err)
+	}
+	if expected := []UIDRange{{0, 499}, {65534, 65534}, {1000, 1010}}; !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+
+	if ranges, err = ParseUIDRanges(""); err != nil || ranges != nil {
+		t.Errorf("expected no ranges, got %v, %v", ranges, err)
+	}
+
+	for _, s := range []string{"abc", "500-499", "-1", "1-2-3", "4294967296"} {
+		if _, err = ParseUIDRanges(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarded request headers, in the order they're used
+const (
+	ForwardedHeader    = "Forwarded"
+	ForwardedForHeader = "X-Forwarded-For"
+	RealIPHeader       = "X-Real-IP"
+)
+
+// TrustedProxies is a list of networks proxies are trusted to send forwarded headers from
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDRs, e.g. 10.0.0.0/8. Single IP addresses are also accepted
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", s)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// Contains returns true if ip is in a trusted network
+func (p TrustedProxies) Contains(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= addresses of the Forwarded header values, in order.
+// Ports are removed, and unknown or obfuscated identifiers (which aren't IP addresses) are returned as is
+func forwardedFor(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, elem := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				v = strings.Trim(v, `"`)
+				if strings.HasPrefix(v, "[") {
+					if end := strings.IndexByte(v, ']'); end != -1 {
+						v = v[1:end]
+					}
+				} else if host, _, err := net.SplitHostPort(v); err == nil {
+					v = host
+				}
+				addrs = append(addrs, v)
+			}
+		}
+	}
+	return addrs
+}
+
+// forwardedList returns the comma separated addresses of the X-Forwarded-For header values, in order
+func forwardedList(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	return addrs
+}
+
+// ClientIP returns the IP address of the client that made r.
+// If r's peer is a trusted proxy, the client is found from the Forwarded, X-Forwarded-For, or X-Real-IP header, in that order.
+// Otherwise these headers are ignored and the peer is the client, so a client can't spoof its address by sending them itself.
+// Forwarded and X-Forwarded-For are read right to left, skipping trusted proxies. The walk stops at the first address that isn't trusted,
+// or at an unknown or obfuscated identifier, which is treated as an untrusted hop whose address is the nearest trusted proxy's
+func (p TrustedProxies) ClientIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("could not parse remote address: %w", err)
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !p.Contains(peer) {
+		return host, nil
+	}
+
+	var addrs []string
+	if values := r.Header.Values(ForwardedHeader); len(values) != 0 {
+		addrs = forwardedFor(values)
+	} else if values := r.Header.Values(ForwardedForHeader); len(values) != 0 {
+		addrs = forwardedList(values)
+	} else if value := r.Header.Get(RealIPHeader); value != "" {
+		addrs = []string{strings.TrimSpace(value)}
+	} else {
+		return host, nil
+	}
+
+	//the rightmost address that isn't a trusted proxy is the client. If every address is trusted, the leftmost is the client
+	client := peer
+	for idx := len(addrs) - 1; idx >= 0; idx-- {
+		ip := net.ParseIP(addrs[idx])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !p.Contains(ip) {
+			break
+		}
+	}
+	return client.String(), nil
+}
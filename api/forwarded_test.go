@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 127.0.0.1", "::1", "fd00::/8", ""})
+	if err != nil {
+		t.Fatal("could not parse:", err)
+	}
+	if len(proxies) != 4 {
+		t.Fatalf("expected 4 networks, got %v", proxies)
+	}
+	if s := proxies[1].String(); s != "127.0.0.1/32" {
+		t.Errorf("expected 127.0.0.1/32, got %s", s)
+	}
+	if s := proxies[2].String(); s != "::1/128" {
+		t.Errorf("expected ::1/128, got %s", s)
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err = ParseTrustedProxies([]string{s}); err == nil {
+			t.Errorf("expected %q to fail", s)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal("could not parse:", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		ip      string
+	}{
+		{"direct", "1.2.3.4:5678", nil, "1.2.3.4"},
+		{"untrusted x-forwarded-for", "1.2.3.4:5678", map[string][]string{ForwardedForHeader: {"5.6.7.8"}}, "1.2.3.4"},
+		{"untrusted forwarded", "1.2.3.4:5678", map[string][]string{ForwardedHeader: {"for=5.6.7.8"}}, "1.2.3.4"},
+		{"untrusted x-real-ip", "1.2.3.4:5678", map[string][]string{RealIPHeader: {"5.6.7.8"}}, "1.2.3.4"},
+		{"trusted without headers", "10.0.0.1:5678", nil, "10.0.0.1"},
+		{"x-forwarded-for", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"1.2.3.4"}}, "1.2.3.4"},
+		{"x-forwarded-for multi-hop", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"1.2.3.4, 10.0.0.2"}}, "1.2.3.4"},
+		{"x-forwarded-for spoofed", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"9.9.9.9, 1.2.3.4, 10.0.0.2"}}, "1.2.3.4"},
+		{"x-forwarded-for multiple headers", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"9.9.9.9", "1.2.3.4"}}, "1.2.3.4"},
+		{"x-forwarded-for all trusted", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"x-forwarded-for invalid", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"1.2.3.4, garbage"}}, "10.0.0.1"},
+		{"x-forwarded-for invalid past client", "10.0.0.1:5678", map[string][]string{ForwardedForHeader: {"garbage, 1.2.3.4"}}, "1.2.3.4"},
+		{"forwarded", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {`for=1.2.3.4;proto=https, for="10.0.0.2:8080"`}}, "1.2.3.4"},
+		{"forwarded ipv6", "[fd00::1]:5678", map[string][]string{ForwardedHeader: {`For="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"forwarded unknown", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {"for=unknown"}}, "10.0.0.1"},
+		{"forwarded unknown behind proxy", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {"for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded obfuscated", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {`for="_hidden", for=10.0.0.2`}}, "10.0.0.2"},
+		{"forwarded obfuscated stops walk", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {"for=1.2.3.4, for=_hidden"}}, "10.0.0.1"},
+		{"forwarded without for", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {"proto=https"}}, "10.0.0.1"},
+		{"forwarded preferred", "10.0.0.1:5678", map[string][]string{ForwardedHeader: {"for=1.2.3.4"}, ForwardedForHeader: {"5.6.7.8"}}, "1.2.3.4"},
+		{"x-real-ip", "10.0.0.1:5678", map[string][]string{RealIPHeader: {" 1.2.3.4 "}}, "1.2.3.4"},
+		{"x-real-ip invalid", "10.0.0.1:5678", map[string][]string{RealIPHeader: {"1.2.3.4, 5.6.7.8"}}, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("POST", "/api/v2/submit", nil)
+		r.RemoteAddr = test.remote
+		for k, vs := range test.headers {
+			for _, v := range vs {
+				r.Header.Add(k, v)
+			}
+		}
+		ip, err := proxies.ClientIP(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if ip != test.ip {
+			t.Errorf("%s: expected %q, got %q", test.name, test.ip, ip)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// parseIP parses s as an IP address, converting IPv4-mapped IPv6 addresses to IPv4 and removing any zone.
+// An empty string returns the zero Addr
+func parseIP(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// normalizeIP returns the canonical form of s, or s if it isn't a valid address
+func normalizeIP(s string) string {
+	addr, err := parseIP(s)
+	if err != nil || !addr.IsValid() {
+		return s
+	}
+	return addr.String()
+}
+
+// ipBytes returns the binary form of addr as stored in the database:
+// 4 bytes for IPv4, 16 bytes for IPv6, or empty for the zero Addr.
+// This is the same format used by MySQL's INET6_ATON and INET6_NTOA
+func ipBytes(addr netip.Addr) []byte {
+	if !addr.IsValid() {
+		return []byte{}
+	}
+	return addr.AsSlice()
+}
+
+// ipString returns the string form of the binary address b, or an empty string if b isn't a valid address
+func ipString(b []byte) string {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// legacyIP converts an address stored as text before migration 2 to binary.
+// Multi-hop X-Forwarded-For values use the first address, and unparsable values are stored as empty
+func legacyIP(s string) []byte {
+	s = strings.TrimSpace(strings.Split(s, ",")[0])
+	addr, err := parseIP(s)
+	if err != nil {
+		return []byte{}
+	}
+	return ipBytes(addr)
+}
+
+// migrateAddressBinary fills in address.ip_bin and address.internetip_bin from the text columns.
+// Rows that normalize to the same addresses are merged, along with any identities that then become duplicates
+func migrateAddressBinary(tx *sql.Tx, d *dialect) error {
+	type address struct {
+		id             int
+		ip, internetip []byte
+	}
+
+	rows, err := tx.Query("SELECT id, ip, internetip FROM address ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("could not query addresses: %w", err)
+	}
+	var addresses []*address
+	for rows.Next() {
+		var ip, internetip string
+		a := new(address)
+		if err = rows.Scan(&(a.id), &ip, &internetip); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan address: %w", err)
+		}
+		a.ip, a.internetip = legacyIP(ip), legacyIP(internetip)
+		addresses = append(addresses, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not scan addresses: %w", err)
+	}
+
+	kept := make(map[string]int)
+	for _, a := range addresses {
+		key := string(a.ip) + "/" + string(a.internetip)
+		id, ok := kept[key]
+		if !ok {
+			kept[key] = a.id
+			if _, err = tx.Exec(d.rebind("UPDATE address SET ip_bin=?, internetip_bin=? WHERE id=?"), a.ip, a.internetip, a.id); err != nil {
+				return fmt.Errorf("could not update address: %w", err)
+			}
+			continue
+		}
+
+		if err = mergeAddress(tx, d, a.id, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeAddress moves all identities using address from to address to, then deletes from
+func mergeAddress(tx *sql.Tx, d *dialect, from, to int) error {
+	type identity struct {
+		id, userID, deviceID int
+	}
+
+	rows, err := tx.Query(d.rebind("SELECT id, user_id, device_id FROM identity WHERE address_id=?"), from)
+	if err != nil {
+		return fmt.Errorf("could not query identities: %w", err)
+	}
+	var identities []*identity
+	for rows.Next() {
+		i := new(identity)
+		if err = rows.Scan(&(i.id), &(i.userID), &(i.deviceID)); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan identity: %w", err)
+		}
+		identities = append(identities, i)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not scan identities: %w", err)
+	}
+
+	for _, i := range identities {
+		var existing int
+		err = tx.QueryRow(d.rebind("SELECT id FROM identity WHERE user_id=? AND device_id=? AND address_id=?"), i.userID, i.deviceID, to).Scan(&existing)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err = tx.Exec(d.rebind("UPDATE identity SET address_id=? WHERE id=?"), to, i.id); err != nil {
+				return fmt.Errorf("could not update identity: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("could not query identity: %w", err)
+		default:
+			if _, err = tx.Exec(d.rebind("UPDATE log SET identity_id=? WHERE identity_id=?"), existing, i.id); err != nil {
+				return fmt.Errorf("could not update log: %w", err)
+			}
+			if _, err = tx.Exec(d.rebind("DELETE FROM identity WHERE id=?"), i.id); err != nil {
+				return fmt.Errorf("could not delete identity: %w", err)
+			}
+		}
+	}
+
+	if _, err = tx.Exec(d.rebind("DELETE FROM address WHERE id=?"), from); err != nil {
+		return fmt.Errorf("could not delete address: %w", err)
+	}
+	return nil
+}
+
+// migrateAddressText fills in the text address.ip and address.internetip from the binary columns
+func migrateAddressText(tx *sql.Tx, d *dialect) error {
+	type address struct {
+		id             int
+		ip, internetip []byte
+	}
+
+	rows, err := tx.Query("SELECT id, ip_bin, internetip_bin FROM address")
+	if err != nil {
+		return fmt.Errorf("could not query addresses: %w", err)
+	}
+	var addresses []*address
+	for rows.Next() {
+		a := new(address)
+		if err = rows.Scan(&(a.id), &(a.ip), &(a.internetip)); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan address: %w", err)
+		}
+		addresses = append(addresses, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not scan addresses: %w", err)
+	}
+
+	for _, a := range addresses {
+		if _, err = tx.Exec(d.rebind("UPDATE address SET ip=?, internetip=? WHERE id=?"), ipString(a.ip), ipString(a.internetip), a.id); err != nil {
+			return fmt.Errorf("could not update address: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFS embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const createSchemaVersion = `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INT NOT NULL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`
+
+// ErrNoMigration is returned by Migrator.Down if there are no applied migrations to revert
+var ErrNoMigration = errors.New("no applied migrations")
+
+// migrationHook is a data migration that can't be expressed in SQL.
+// Up is run after the up script and Down is run after the down script
+type migrationHook struct {
+	Up   func(*sql.Tx, *dialect) error
+	Down func(*sql.Tx, *dialect) error
+}
+
+// migrationHooks are the hooks run for each migration version
+var migrationHooks = map[int]*migrationHook{
+	2: {Up: migrateAddressBinary},
+	3: {Down: migrateAddressText},
+}
+
+// migration represents a single versioned schema change
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Hook    *migrationHook
+}
+
+// MigrationStatus represents the state of a single migration
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts the embedded schema migrations for a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    *dialect
+	migrations []*migration
+	close      bool
+}
+
+// loadMigrations returns the sorted migrations for the named dialect
+func loadMigrations(name string) ([]*migration, error) {
+	dir := path.Join("migrations", name)
+	files, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations: %w", err)
+	}
+
+	versions := make(map[int]*migration)
+	for _, f := range files {
+		m := migrationName.FindStringSubmatch(f.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration filename: %s", f.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		buf, err := migrationFS.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %w", f.Name(), err)
+		}
+
+		mig, ok := versions[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2], Hook: migrationHooks[version]}
+			versions[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("conflicting names for migration %d: %s, %s", version, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.Up = string(buf)
+		} else {
+			mig.Down = string(buf)
+		}
+	}
+
+	migrations := make([]*migration, 0, len(versions))
+	for _, mig := range versions {
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// newMigrator returns a new Migrator for an already opened database
+func newMigrator(dia *dialect, db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(dia.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dia, migrations: migrations}, nil
+}
+
+// NewMigrator opens the database with the given driver and dsn and returns a new Migrator for it
+func NewMigrator(driver, dsn string) (*Migrator, error) {
+	dia, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dia.singleConn {
+		db.SetMaxOpenConns(1)
+	}
+	m, err := newMigrator(dia, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	m.close = true
+	return m, nil
+}
+
+// Close closes the underlying database if it was opened by NewMigrator
+func (m *Migrator) Close() error {
+	if !m.close {
+		return nil
+	}
+	return m.db.Close()
+}
+
+// splitStatements splits a SQL script into individual statements
+func splitStatements(script string) []string {
+	var (
+		stmts   []string
+		start   int
+		literal bool
+	)
+	for i := 0; i < len(script); i++ {
+		switch script[i] {
+		case '\'':
+			literal = !literal
+		case ';':
+			if literal {
+				continue
+			}
+			if s := strings.TrimSpace(script[start:i]); s != "" {
+				stmts = append(stmts, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(script[start:]); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// applied returns the applied migration versions and when they were applied.
+// A database created from sql/v1.1.1.sql before migrations existed is recorded as being at version 1
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	if _, err := m.db.Exec(createSchemaVersion); err != nil {
+		return nil, fmt.Errorf("could not create schema_version: %w", err)
+	}
+
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("could not query schema_version: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			t       time.Time
+		)
+		if err = rows.Scan(&version, &t); err != nil {
+			return nil, fmt.Errorf("could not scan schema_version: %w", err)
+		}
+		versions[version] = t
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan schema_version: %w", err)
+	}
+	rows.Close()
+
+	if len(versions) != 0 || len(m.migrations) == 0 || m.migrations[0].Version != 1 {
+		return versions, nil
+	}
+
+	if _, err = m.db.Exec("SELECT id FROM log WHERE 1=0"); err != nil {
+		//empty database
+		return versions, nil
+	}
+
+	log.Println("Existing schema found; marking migration 1 as applied")
+	t := time.Now().UTC()
+	if _, err = m.db.Exec(m.dialect.rebind("INSERT INTO schema_version(version, name, applied_at) VALUES(?, ?, ?)"),
+		1, m.migrations[0].Name, t); err != nil {
+		return nil, fmt.Errorf("could not update schema_version: %w", err)
+	}
+	versions[1] = t
+
+	return versions, nil
+}
+
+// run executes script and any hook and updates schema_version in a single transaction.
+// MySQL implicitly commits each DDL statement, so a failed migration can leave part of its changes applied without a schema_version row.
+// Statements that fail because their change was already made, as returned by dialect.applied, are skipped so the migration can be run again
+func (m *Migrator) run(mig *migration, script string, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(script) {
+		if _, err = tx.Exec(stmt); err != nil {
+			if m.dialect.applied != nil && m.dialect.applied(err) {
+				log.Printf("Skipping already applied statement: %s\n\t%v\n", stmt, err)
+				continue
+			}
+			return fmt.Errorf("could not execute statement: %s\n\t%w", stmt, err)
+		}
+	}
+
+	if mig.Hook != nil {
+		hook := mig.Hook.Down
+		if up {
+			hook = mig.Hook.Up
+		}
+		if hook != nil {
+			if err = hook(tx, m.dialect); err != nil {
+				return err
+			}
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(m.dialect.rebind("INSERT INTO schema_version(version, name, applied_at) VALUES(?, ?, ?)"),
+			mig.Version, mig.Name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(m.dialect.rebind("DELETE FROM schema_version WHERE version=?"), mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("could not update schema_version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Up applies all pending migrations in order and returns the number applied
+func (m *Migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		log.Printf("Applying migration %d_%s\n", mig.Version, mig.Name)
+		if err = m.run(mig, mig.Up, true); err != nil {
+			return count, fmt.Errorf("could not apply migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Down reverts the most recently applied migration
+func (m *Migrator) Down() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		log.Printf("Reverting migration %d_%s\n", mig.Version, mig.Name)
+		if err = m.run(mig, mig.Down, false); err != nil {
+			return fmt.Errorf("could not revert migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		return nil
+	}
+
+	return ErrNoMigration
+}
+
+// Status returns the status of every known migration
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		t, ok := applied[mig.Version]
+		statuses = append(statuses, &MigrationStatus{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			Applied:   ok,
+			AppliedAt: t,
+		})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	m, err := NewMigrator("sqlite", filepath.Join(t.TempDir(), "chronicle.db"))
+	if err != nil {
+		t.Fatal("could not create migrator:", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	m := newTestMigrator(t)
+
+	n, err := m.Up()
+	if err != nil {
+		t.Fatal("could not migrate up:", err)
+	}
+	if n != len(m.migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(m.migrations), n)
+	}
+
+	if n, err = m.Up(); err != nil || n != 0 {
+		t.Errorf("expected no migrations applied, got %d, %v", n, err)
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal("could not get status:", err)
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.AppliedAt.IsZero() {
+			t.Errorf("expected migration %d_%s to be applied", s.Version, s.Name)
+		}
+	}
+
+	for range m.migrations {
+		if err = m.Down(); err != nil {
+			t.Fatal("could not migrate down:", err)
+		}
+	}
+	if err = m.Down(); !errors.Is(err, ErrNoMigration) {
+		t.Errorf("expected ErrNoMigration, got %v", err)
+	}
+	if _, err = m.db.Exec("SELECT id FROM log"); err == nil {
+		t.Error("expected log table to be dropped")
+	}
+}
+
+func TestMigrateExistingSchema(t *testing.T) {
+	m := newTestMigrator(t)
+
+	//simulate a database created by hand from sql/v1.1.1.sql
+	for _, stmt := range splitStatements(m.migrations[0].Up) {
+		if _, err := m.db.Exec(stmt); err != nil {
+			t.Fatal("could not create schema:", err)
+		}
+	}
+
+	if _, err := m.Up(); err != nil {
+		t.Fatal("could not migrate up:", err)
+	}
+
+	var name string
+	if err := m.db.QueryRow("SELECT name FROM schema_version WHERE version=1").Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			t.Fatal("expected migration 1 to be recorded")
+		}
+		t.Fatal("could not query schema_version:", err)
+	}
+}
+
+func TestMigrateRerun(t *testing.T) {
+	m := newTestMigrator(t)
+	m.migrations = []*migration{{Version: 1, Name: "rerun", Up: "CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);"}}
+
+	//a previous run failed after creating a
+	if _, err := m.db.Exec("CREATE TABLE a (id INT)"); err != nil {
+		t.Fatal("could not create table:", err)
+	}
+	if _, err := m.Up(); err == nil {
+		t.Fatal("expected already created table to fail without dialect.applied")
+	}
+
+	dia := *m.dialect
+	dia.applied = func(err error) bool { return strings.Contains(err.Error(), "already exists") }
+	m.dialect = &dia
+	if n, err := m.Up(); err != nil || n != 1 {
+		t.Fatalf("expected migration applied, got %d, %v", n, err)
+	}
+	if _, err := m.db.Exec("INSERT INTO b(id) VALUES(1)"); err != nil {
+		t.Error("expected table b to be created:", err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements("CREATE TABLE a (b VARCHAR(1) DEFAULT ';');\n\nINSERT INTO a VALUES('x');\n")
+	if len(stmts) != 2 || stmts[0] != "CREATE TABLE a (b VARCHAR(1) DEFAULT ';')" || stmts[1] != "INSERT INTO a VALUES('x')" {
+		t.Errorf("unexpected statements: %q", stmts)
+	}
+}
+
+func TestMigrateAddressBinary(t *testing.T) {
+	m := newTestMigrator(t)
+
+	//create a version 1 database with text addresses that normalize to the same values
+	for _, stmt := range splitStatements(m.migrations[0].Up) {
+		if _, err := m.db.Exec(stmt); err != nil {
+			t.Fatal("could not create schema:", err)
+		}
+	}
+	for _, stmt := range []string{
+		`INSERT INTO "user"(id, uid, username, fullname) VALUES(1, 501, 'alice', 'Alice')`,
+		`INSERT INTO device(id, serial, clientidentifier, hostname) VALUES(1, 'SERIAL1', '', 'host1')`,
+		`INSERT INTO address(id, ip, internetip) VALUES(1, '10.0.0.1', '1.2.3.4')`,
+		`INSERT INTO address(id, ip, internetip) VALUES(2, '10.0.0.1', '::ffff:1.2.3.4')`,
+		`INSERT INTO address(id, ip, internetip) VALUES(3, '10.0.0.2', '5.6.7.8,10.1.1.1')`,
+		`INSERT INTO identity(id, user_id, device_id, address_id) VALUES(1, 1, 1, 1)`,
+		`INSERT INTO identity(id, user_id, device_id, address_id) VALUES(2, 1, 1, 2)`,
+		`INSERT INTO identity(id, user_id, device_id, address_id) VALUES(3, 1, 1, 3)`,
+		`INSERT INTO log(identity_id, time) VALUES(1, '2020-01-01 00:00:00')`,
+		`INSERT INTO log(identity_id, time) VALUES(2, '2020-01-01 00:00:01')`,
+		`INSERT INTO log(identity_id, time) VALUES(3, '2020-01-01 00:00:02')`,
+	} {
+		if _, err := m.db.Exec(stmt); err != nil {
+			t.Fatal("could not insert data:", err)
+		}
+	}
+
+	if _, err := m.Up(); err != nil {
+		t.Fatal("could not migrate up:", err)
+	}
+
+	rows, err := m.db.Query("SELECT address.id, ip, internetip, COUNT(log.id) FROM address INNER JOIN identity ON address.id = identity.address_id INNER JOIN log ON identity.id = log.identity_id GROUP BY address.id, ip, internetip ORDER BY address.id")
+	if err != nil {
+		t.Fatal("could not query addresses:", err)
+	}
+	defer rows.Close()
+	expected := []string{"1 10.0.0.1 1.2.3.4 2", "3 10.0.0.2 5.6.7.8 1"}
+	var actual []string
+	for rows.Next() {
+		var (
+			id, count      int
+			ip, internetip []byte
+		)
+		if err = rows.Scan(&id, &ip, &internetip, &count); err != nil {
+			t.Fatal("could not scan address:", err)
+		}
+		actual = append(actual, fmt.Sprintf("%d %s %s %d", id, ipString(ip), ipString(internetip), count))
+	}
+	rows.Close()
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected addresses %v, got %v", expected, actual)
+	}
+
+	//revert to text addresses
+	for i := 1; i < len(m.migrations); i++ {
+		if err = m.Down(); err != nil {
+			t.Fatal("could not migrate down:", err)
+		}
+	}
+	var ip, internetip string
+	if err = m.db.QueryRow("SELECT ip, internetip FROM address WHERE id=3").Scan(&ip, &internetip); err != nil {
+		t.Fatal("could not query address:", err)
+	}
+	if ip != "10.0.0.2" || internetip != "5.6.7.8" {
+		t.Errorf("unexpected address after down: %s, %s", ip, internetip)
+	}
+}
@@ -0,0 +1,8 @@
+ALTER TABLE address
+    DROP COLUMN ip_bin,
+    DROP COLUMN internetip_bin,
+    MODIFY ip VARCHAR(45) NOT NULL,
+    MODIFY internetip VARCHAR(45) NOT NULL,
+    ADD UNIQUE(ip, internetip);
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
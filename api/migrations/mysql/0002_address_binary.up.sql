@@ -0,0 +1,6 @@
+ALTER TABLE address
+    DROP INDEX ip,
+    DROP INDEX address_ip,
+    DROP INDEX address_internetip,
+    ADD COLUMN ip_bin VARBINARY(16) NULL,
+    ADD COLUMN internetip_bin VARBINARY(16) NULL;
@@ -0,0 +1,9 @@
+ALTER TABLE address
+    DROP INDEX ip,
+    DROP INDEX address_ip,
+    DROP INDEX address_internetip,
+    CHANGE ip ip_bin VARBINARY(16) NULL,
+    CHANGE internetip internetip_bin VARBINARY(16) NULL;
+ALTER TABLE address
+    ADD COLUMN ip VARCHAR(45) NULL,
+    ADD COLUMN internetip VARCHAR(45) NULL;
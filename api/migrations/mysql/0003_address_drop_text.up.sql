@@ -0,0 +1,9 @@
+-- a single statement, since if the columns were renamed separately, running this again after a failure would drop them
+ALTER TABLE address
+    DROP COLUMN ip,
+    DROP COLUMN internetip,
+    CHANGE ip_bin ip VARBINARY(16) NOT NULL,
+    CHANGE internetip_bin internetip VARBINARY(16) NOT NULL,
+    ADD UNIQUE(ip, internetip),
+    ADD INDEX address_ip(ip),
+    ADD INDEX address_internetip(internetip);
@@ -0,0 +1,3 @@
+ALTER TABLE log DROP FOREIGN KEY log_platform_id_fk;
+ALTER TABLE log DROP COLUMN platform_id;
+DROP TABLE platform;
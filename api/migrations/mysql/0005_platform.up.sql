@@ -0,0 +1,15 @@
+CREATE TABLE platform (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    os_version VARCHAR(32) NOT NULL,
+    os_build VARCHAR(32) NOT NULL,
+    model VARCHAR(64) NOT NULL,
+    client_version VARCHAR(32) NOT NULL,
+    mac_addresses VARCHAR(255) NOT NULL,
+    UNIQUE(os_version, os_build, model, client_version, mac_addresses)
+);
+CREATE INDEX platform_os_version ON platform(os_version);
+CREATE INDEX platform_model ON platform(model);
+
+ALTER TABLE log
+    ADD COLUMN platform_id INT NULL,
+    ADD CONSTRAINT log_platform_id_fk FOREIGN KEY(platform_id) REFERENCES platform(id);
@@ -0,0 +1,5 @@
+ALTER TABLE log DROP FOREIGN KEY log_attribute_set_id_fk;
+ALTER TABLE log DROP COLUMN attribute_set_id;
+DROP TABLE attribute_set_member;
+DROP TABLE attribute_set;
+DROP TABLE attribute;
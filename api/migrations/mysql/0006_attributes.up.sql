@@ -0,0 +1,25 @@
+CREATE TABLE attribute (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    UNIQUE(name, value)
+);
+
+CREATE TABLE attribute_set (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    hash CHAR(32) NOT NULL,
+    UNIQUE(hash)
+);
+
+CREATE TABLE attribute_set_member (
+    attribute_set_id INT NOT NULL,
+    attribute_id INT NOT NULL,
+    PRIMARY KEY(attribute_set_id, attribute_id),
+    FOREIGN KEY(attribute_set_id) REFERENCES attribute_set(id),
+    FOREIGN KEY(attribute_id) REFERENCES attribute(id)
+);
+CREATE INDEX attribute_set_member_attribute_id ON attribute_set_member(attribute_id);
+
+ALTER TABLE log
+    ADD COLUMN attribute_set_id INT NULL,
+    ADD CONSTRAINT log_attribute_set_id_fk FOREIGN KEY(attribute_set_id) REFERENCES attribute_set(id);
@@ -0,0 +1,3 @@
+-- the implicit foreign key index on identity_id is replaced by log_identity_id_time, so it has to be recreated first
+CREATE INDEX identity_id ON log(identity_id);
+DROP INDEX log_identity_id_time ON log;
@@ -0,0 +1 @@
+CREATE INDEX log_identity_id_time ON log(identity_id, time);
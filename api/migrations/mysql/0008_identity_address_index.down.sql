@@ -0,0 +1,2 @@
+-- identity.address_id is already indexed for its foreign key, so this is a no-op kept so MySQL has the same migration versions as the other databases
+SELECT 1;
@@ -0,0 +1,10 @@
+CREATE TABLE session (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    identity_id INT NOT NULL,
+    start_time DATETIME NOT NULL,
+    end_time DATETIME NOT NULL,
+    check_ins INT NOT NULL,
+    FOREIGN KEY(identity_id) REFERENCES identity(id)
+);
+CREATE INDEX session_identity_id_end_time ON session(identity_id, end_time);
+CREATE INDEX session_start_time ON session(start_time);
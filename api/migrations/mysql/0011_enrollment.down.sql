@@ -0,0 +1,2 @@
+DROP TABLE device_token;
+DROP TABLE enrollment_secret;
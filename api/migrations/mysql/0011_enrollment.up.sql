@@ -0,0 +1,15 @@
+CREATE TABLE enrollment_secret (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    secret_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NULL,
+    used_at DATETIME NULL,
+    serial VARCHAR(32) NULL
+);
+
+CREATE TABLE device_token (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    serial VARCHAR(32) NOT NULL UNIQUE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL
+);
@@ -0,0 +1,5 @@
+DROP TABLE log;
+DROP TABLE identity;
+DROP TABLE address;
+DROP TABLE device;
+DROP TABLE "user";
@@ -0,0 +1,10 @@
+ALTER TABLE address
+    DROP COLUMN ip_bin,
+    DROP COLUMN internetip_bin,
+    ALTER COLUMN ip TYPE VARCHAR(45),
+    ALTER COLUMN ip SET NOT NULL,
+    ALTER COLUMN internetip TYPE VARCHAR(45),
+    ALTER COLUMN internetip SET NOT NULL,
+    ADD UNIQUE(ip, internetip);
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
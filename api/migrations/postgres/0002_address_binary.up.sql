@@ -0,0 +1,6 @@
+ALTER TABLE address DROP CONSTRAINT address_ip_internetip_key;
+DROP INDEX address_ip;
+DROP INDEX address_internetip;
+ALTER TABLE address
+    ADD COLUMN ip_bin BYTEA NULL,
+    ADD COLUMN internetip_bin BYTEA NULL;
@@ -0,0 +1,10 @@
+ALTER TABLE address DROP CONSTRAINT address_ip_internetip_key;
+DROP INDEX address_ip;
+DROP INDEX address_internetip;
+ALTER TABLE address RENAME COLUMN ip TO ip_bin;
+ALTER TABLE address RENAME COLUMN internetip TO internetip_bin;
+ALTER TABLE address
+    ALTER COLUMN ip_bin DROP NOT NULL,
+    ALTER COLUMN internetip_bin DROP NOT NULL,
+    ADD COLUMN ip VARCHAR(45) NULL,
+    ADD COLUMN internetip VARCHAR(45) NULL;
@@ -0,0 +1,11 @@
+ALTER TABLE address
+    DROP COLUMN ip,
+    DROP COLUMN internetip;
+ALTER TABLE address RENAME COLUMN ip_bin TO ip;
+ALTER TABLE address RENAME COLUMN internetip_bin TO internetip;
+ALTER TABLE address
+    ALTER COLUMN ip SET NOT NULL,
+    ALTER COLUMN internetip SET NOT NULL,
+    ADD UNIQUE(ip, internetip);
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
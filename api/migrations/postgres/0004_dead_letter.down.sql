@@ -0,0 +1 @@
+DROP TABLE dead_letter;
@@ -0,0 +1,8 @@
+CREATE TABLE dead_letter (
+    id BIGSERIAL PRIMARY KEY,
+    time TIMESTAMP NOT NULL,
+    entry TEXT NOT NULL,
+    error TEXT NOT NULL,
+    attempts INT NOT NULL
+);
+CREATE INDEX dead_letter_time ON dead_letter(time);
@@ -0,0 +1,2 @@
+ALTER TABLE log DROP COLUMN platform_id;
+DROP TABLE platform;
@@ -0,0 +1,4 @@
+ALTER TABLE log DROP COLUMN attribute_set_id;
+DROP TABLE attribute_set_member;
+DROP TABLE attribute_set;
+DROP TABLE attribute;
@@ -0,0 +1,22 @@
+CREATE TABLE attribute (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    UNIQUE(name, value)
+);
+
+CREATE TABLE attribute_set (
+    id SERIAL PRIMARY KEY,
+    hash CHAR(32) NOT NULL,
+    UNIQUE(hash)
+);
+
+CREATE TABLE attribute_set_member (
+    attribute_set_id INT NOT NULL REFERENCES attribute_set(id),
+    attribute_id INT NOT NULL REFERENCES attribute(id),
+    PRIMARY KEY(attribute_set_id, attribute_id)
+);
+CREATE INDEX attribute_set_member_attribute_id ON attribute_set_member(attribute_id);
+
+ALTER TABLE log ADD COLUMN attribute_set_id INT NULL REFERENCES attribute_set(id);
+CREATE INDEX log_attribute_set_id ON log(attribute_set_id);
@@ -0,0 +1 @@
+DROP INDEX identity_address_id;
@@ -0,0 +1,9 @@
+CREATE TABLE session (
+    id BIGSERIAL PRIMARY KEY,
+    identity_id INT NOT NULL REFERENCES identity(id),
+    start_time TIMESTAMP NOT NULL,
+    end_time TIMESTAMP NOT NULL,
+    check_ins INT NOT NULL
+);
+CREATE INDEX session_identity_id_end_time ON session(identity_id, end_time);
+CREATE INDEX session_start_time ON session(start_time);
@@ -0,0 +1,9 @@
+CREATE TABLE api_key (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE
+);
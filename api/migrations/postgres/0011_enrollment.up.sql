@@ -0,0 +1,15 @@
+CREATE TABLE enrollment_secret (
+    id SERIAL PRIMARY KEY,
+    secret_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NULL,
+    used_at TIMESTAMP NULL,
+    serial VARCHAR(32) NULL
+);
+
+CREATE TABLE device_token (
+    id SERIAL PRIMARY KEY,
+    serial VARCHAR(32) NOT NULL UNIQUE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,45 @@
+CREATE TABLE "user" (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uid INTEGER NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    fullname VARCHAR(128) NOT NULL,
+    UNIQUE(uid, username, fullname)
+);
+CREATE INDEX user_uid ON "user"(uid);
+CREATE INDEX user_username ON "user"(username);
+CREATE INDEX user_fullname ON "user"(fullname);
+
+CREATE TABLE device (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    serial VARCHAR(32) NOT NULL,
+    clientidentifier VARCHAR(64) NOT NULL,
+    hostname VARCHAR(32) NOT NULL,
+    UNIQUE(serial, clientidentifier, hostname)
+);
+CREATE INDEX device_serial ON device(serial);
+CREATE INDEX device_clientidentifier ON device(clientidentifier);
+CREATE INDEX device_hostname ON device(hostname);
+
+CREATE TABLE address (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip VARCHAR(15) NOT NULL,
+    internetip VARCHAR(15) NOT NULL,
+    UNIQUE(ip, internetip)
+);
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
+
+CREATE TABLE identity (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES "user"(id),
+    device_id INTEGER NOT NULL REFERENCES device(id),
+    address_id INTEGER NOT NULL REFERENCES address(id),
+    UNIQUE(user_id, device_id, address_id)
+);
+
+CREATE TABLE log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identity_id INTEGER NOT NULL REFERENCES identity(id),
+    time DATETIME NOT NULL
+);
+CREATE INDEX log_time ON log(time);
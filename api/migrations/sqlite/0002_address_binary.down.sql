@@ -0,0 +1,11 @@
+CREATE TABLE address_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip VARCHAR(45) NOT NULL,
+    internetip VARCHAR(45) NOT NULL,
+    UNIQUE(ip, internetip)
+);
+INSERT INTO address_new(id, ip, internetip) SELECT id, ip, internetip FROM address;
+DROP TABLE address;
+ALTER TABLE address_new RENAME TO address;
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
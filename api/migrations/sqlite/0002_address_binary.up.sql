@@ -0,0 +1,10 @@
+CREATE TABLE address_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip VARCHAR(15) NOT NULL,
+    internetip VARCHAR(15) NOT NULL,
+    ip_bin BLOB NULL,
+    internetip_bin BLOB NULL
+);
+INSERT INTO address_new(id, ip, internetip) SELECT id, ip, internetip FROM address;
+DROP TABLE address;
+ALTER TABLE address_new RENAME TO address;
@@ -0,0 +1,11 @@
+CREATE TABLE address_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip BLOB NOT NULL,
+    internetip BLOB NOT NULL,
+    UNIQUE(ip, internetip)
+);
+INSERT INTO address_new(id, ip, internetip) SELECT id, ip_bin, internetip_bin FROM address;
+DROP TABLE address;
+ALTER TABLE address_new RENAME TO address;
+CREATE INDEX address_ip ON address(ip);
+CREATE INDEX address_internetip ON address(internetip);
@@ -0,0 +1,8 @@
+CREATE TABLE dead_letter (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time DATETIME NOT NULL,
+    entry TEXT NOT NULL,
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL
+);
+CREATE INDEX dead_letter_time ON dead_letter(time);
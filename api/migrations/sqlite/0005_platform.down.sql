@@ -0,0 +1,10 @@
+CREATE TABLE log_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identity_id INTEGER NOT NULL REFERENCES identity(id),
+    time DATETIME NOT NULL
+);
+INSERT INTO log_new(id, identity_id, time) SELECT id, identity_id, time FROM log;
+DROP TABLE log;
+ALTER TABLE log_new RENAME TO log;
+CREATE INDEX log_time ON log(time);
+DROP TABLE platform;
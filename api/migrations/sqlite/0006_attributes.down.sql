@@ -0,0 +1,13 @@
+CREATE TABLE log_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identity_id INTEGER NOT NULL REFERENCES identity(id),
+    time DATETIME NOT NULL,
+    platform_id INTEGER NULL REFERENCES platform(id)
+);
+INSERT INTO log_new(id, identity_id, time, platform_id) SELECT id, identity_id, time, platform_id FROM log;
+DROP TABLE log;
+ALTER TABLE log_new RENAME TO log;
+CREATE INDEX log_time ON log(time);
+DROP TABLE attribute_set_member;
+DROP TABLE attribute_set;
+DROP TABLE attribute;
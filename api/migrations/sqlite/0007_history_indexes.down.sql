@@ -0,0 +1,2 @@
+DROP INDEX log_identity_id_time;
+DROP INDEX identity_device_id;
@@ -0,0 +1,2 @@
+CREATE INDEX identity_device_id ON identity(device_id);
+CREATE INDEX log_identity_id_time ON log(identity_id, time);
@@ -0,0 +1 @@
+CREATE INDEX identity_address_id ON identity(address_id);
@@ -0,0 +1,9 @@
+CREATE TABLE session (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identity_id INTEGER NOT NULL REFERENCES identity(id),
+    start_time DATETIME NOT NULL,
+    end_time DATETIME NOT NULL,
+    check_ins INTEGER NOT NULL
+);
+CREATE INDEX session_identity_id_end_time ON session(identity_id, end_time);
+CREATE INDEX session_start_time ON session(start_time);
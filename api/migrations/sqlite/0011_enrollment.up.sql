@@ -0,0 +1,15 @@
+CREATE TABLE enrollment_secret (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    secret_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NULL,
+    used_at DATETIME NULL,
+    serial VARCHAR(32) NULL
+);
+
+CREATE TABLE device_token (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    serial VARCHAR(32) NOT NULL UNIQUE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL
+);
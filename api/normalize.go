@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldPolicy is what is done with a field that is too long
+type FieldPolicy string
+
+// Field policies
+const (
+	// PolicyReject rejects the Entry
+	PolicyReject FieldPolicy = "reject"
+	// PolicyTruncate truncates the field to its limit at a UTF-8 boundary
+	PolicyTruncate FieldPolicy = "truncate"
+	// PolicyHash truncates the field and replaces its end with a hash of the whole value,
+	// so different long values stay different after truncation
+	PolicyHash FieldPolicy = "hash"
+)
+
+// hashSuffixLen is the length of the suffix added by PolicyHash
+const hashSuffixLen = 9
+
+// ParsePolicies parses a map of JSON field names to policy names
+func ParsePolicies(policies map[string]string) (map[string]FieldPolicy, error) {
+	known := make(map[string]bool)
+	for _, f := range new(Entry).fields() {
+		known[f.name] = true
+	}
+
+	parsed := make(map[string]FieldPolicy, len(policies))
+	for field, policy := range policies {
+		if !known[field] {
+			return nil, fmt.Errorf("unknown field: %s", field)
+		}
+		switch p := FieldPolicy(strings.ToLower(policy)); p {
+		case PolicyReject, PolicyTruncate, PolicyHash:
+			parsed[field] = p
+		default:
+			return nil, fmt.Errorf("unknown policy for %s: %s", field, policy)
+		}
+	}
+	return parsed, nil
+}
+
+// Normalizer rewrites an Entry's fields before it's validated and hashed,
+// so equivalent values are stored as the same row
+type Normalizer struct {
+	// Policies are the policies for fields that are too long by JSON field name. Fields without a policy are rejected
+	Policies map[string]FieldPolicy
+
+	// TrimSpace removes leading and trailing whitespace from every field
+	TrimSpace bool
+
+	// LowercaseHostname converts hostnames to lowercase
+	LowercaseHostname bool
+
+	// DomainSuffixes are removed from the end of hostnames, e.g. "example.com" changes "host.example.com" to "host"
+	DomainSuffixes []string
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a multi-byte character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// hashTruncate truncates s to at most n bytes, replacing the end with "~" and the start of the MD5 hash of s
+func hashTruncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n < hashSuffixLen {
+		return truncateUTF8(s, n)
+	}
+	sum := md5.Sum([]byte(s))
+	return truncateUTF8(s, n-hashSuffixLen) + "~" + hex.EncodeToString(sum[:])[:hashSuffixLen-1]
+}
+
+// hostname returns the normalized form of h
+func (n *Normalizer) hostname(h string) string {
+	if n.LowercaseHostname {
+		h = strings.ToLower(h)
+	}
+	h = strings.TrimSuffix(h, ".")
+	for _, suffix := range n.DomainSuffixes {
+		suffix = "." + strings.Trim(suffix, ".")
+		if len(h) > len(suffix) && strings.EqualFold(h[len(h)-len(suffix):], suffix) {
+			return h[:len(h)-len(suffix)]
+		}
+	}
+	return h
+}
+
+// Normalize rewrites e's fields in place. Fields that are still too long after normalization
+// are truncated according to their policy, or left for Validate to reject
+func (n *Normalizer) Normalize(e *Entry) {
+	if n.TrimSpace {
+		for _, f := range e.fields() {
+			*f.value = strings.TrimSpace(*f.value)
+		}
+		e.IP = strings.TrimSpace(e.IP)
+		if len(e.Attributes) != 0 {
+			attrs := make(map[string]string, len(e.Attributes))
+			for key, value := range e.Attributes {
+				attrs[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+			e.Attributes = attrs
+		}
+	}
+
+	if n.LowercaseHostname || len(n.DomainSuffixes) != 0 {
+		e.Hostname = n.hostname(e.Hostname)
+	}
+
+	for _, f := range e.fields() {
+		switch n.Policies[f.name] {
+		case PolicyTruncate:
+			*f.value = truncateUTF8(*f.value, f.limit)
+		case PolicyHash:
+			*f.value = hashTruncate(*f.value, f.limit)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"hostname", 32, "hostname"},
+		{"hostname", 4, "host"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本語", 5, "日"},
+	}
+	for _, test := range tests {
+		if s := truncateUTF8(test.s, test.n); s != test.expected {
+			t.Errorf("%q, %d: expected %q, got %q", test.s, test.n, test.expected, s)
+		}
+	}
+}
+
+func TestHashTruncate(t *testing.T) {
+	a := hashTruncate(strings.Repeat("é", 40)+"a", 32)
+	b := hashTruncate(strings.Repeat("é", 40)+"b", 32)
+	if len(a) > 32 || !utf8.ValidString(a) {
+		t.Errorf("expected valid string of at most 32 bytes, got %q", a)
+	}
+	if a == b {
+		t.Error("expected different values to have different hashes")
+	}
+	if s := hashTruncate("short", 32); s != "short" {
+		t.Errorf("expected short value to be unchanged, got %q", s)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	policies, err := ParsePolicies(map[string]string{"hostname": "truncate", "full_name": "HASH"})
+	if err != nil {
+		t.Fatal("could not parse policies:", err)
+	}
+	n := &Normalizer{
+		Policies:          policies,
+		TrimSpace:         true,
+		LowercaseHostname: true,
+		DomainSuffixes:    []string{".local", "example.com"},
+	}
+
+	e1 := &Entry{Username: " alice ", FullName: strings.Repeat("A", 200), Serial: "SERIAL1\n", Hostname: "Alice-Mac.Example.COM", IP: " 10.0.0.1"}
+	e2 := &Entry{Username: "alice", FullName: strings.Repeat("A", 200), Serial: "SERIAL1", Hostname: "alice-mac.local.", IP: "10.0.0.1"}
+	n.Normalize(e1)
+	n.Normalize(e2)
+
+	if err = e1.Validate(); err != nil {
+		t.Errorf("expected normalized entry to be valid, got %v", err)
+	}
+	if e1.Username != "alice" || e1.Serial != "SERIAL1" || e1.IP != "10.0.0.1" || e1.Hostname != "alice-mac" {
+		t.Errorf("unexpected normalized entry: %#v", e1)
+	}
+	if len(e1.FullName) != 128 {
+		t.Errorf("expected full_name to be hash-truncated to 128 bytes, got %d", len(e1.FullName))
+	}
+
+	uH1, dH1, _, _ := e1.Hashes()
+	uH2, dH2, _, _ := e2.Hashes()
+	if uH1 != uH2 || dH1 != dH2 {
+		t.Error("expected equivalent entries to have the same hashes")
+	}
+
+	e3 := &Entry{Hostname: strings.Repeat("h", 40), Serial: strings.Repeat("S", 40)}
+	n.Normalize(e3)
+	if len(e3.Hostname) != 32 {
+		t.Errorf("expected hostname to be truncated to 32 bytes, got %d", len(e3.Hostname))
+	}
+	if err = e3.Validate(); err == nil {
+		t.Error("expected serial without a policy to be rejected")
+	}
+
+	for _, p := range []map[string]string{{"hostname": "drop"}, {"host": "truncate"}} {
+		if _, err = ParsePolicies(p); err == nil {
+			t.Errorf("%v: expected error", p)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryColumns are the columns scanned by scanEntries
+const entryColumns = `
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	device.serial,
+	device.clientidentifier,
+	device.hostname,
+	address.ip,
+	address.internetip,
+	log.time,
+	platform.os_version,
+	platform.os_build,
+	platform.model,
+	platform.client_version,
+	platform.mac_addresses,
+	log.attribute_set_id,
+	log.id`
+
+// entryJoins joins log to the tables needed for entryColumns
+const entryJoins = `
+inner join identity on
+	log.identity_id = identity.id
+inner join device on
+	identity.device_id = device.id
+inner join "user" on
+	identity.user_id = "user".id
+inner join address on
+	identity.address_id = address.id
+left join platform on
+	log.platform_id = platform.id`
+
+// placeholders returns n comma separated placeholders
+func placeholders(n int) string {
+	return strings.Join(strings.Split(strings.Repeat("?", n), ""), ",")
+}
+
+// queryEntries runs query, which must select entryColumns, and returns the resulting entries with their attributes
+func (db *DB) queryEntries(query string, args ...interface{}) ([]*Entry, error) {
+	rows, err := db.DB.Query(db.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		entries []*Entry
+		sets    = make(map[int][]*Entry)
+	)
+	for rows.Next() {
+		e := new(Entry)
+		var (
+			ip, internetIP                                 []byte
+			osVersion, osBuild, model, clientVersion, macs sql.NullString
+			setID                                          sql.NullInt64
+		)
+		if err := rows.Scan(&e.UID, &e.Username, &e.FullName, &e.Serial, &e.ClientIdentifier, &e.Hostname,
+			&ip, &internetIP, &e.Time,
+			&osVersion, &osBuild, &model, &clientVersion, &macs, &setID, &e.logID); err != nil {
+			return nil, fmt.Errorf("could not scan row: %w", err)
+		}
+		e.IP, e.InternetIP = ipString(ip), ipString(internetIP)
+		e.OSVersion, e.OSBuild, e.Model, e.ClientVersion = osVersion.String, osBuild.String, model.String, clientVersion.String
+		if macs.String != "" {
+			e.MACAddresses = strings.Split(macs.String, ",")
+		}
+		if setID.Valid {
+			sets[int(setID.Int64)] = append(sets[int(setID.Int64)], e)
+		}
+
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan rows: %w", err)
+	}
+	rows.Close()
+
+	if err = db.loadAttributes(sets); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// loadAttributes sets the attributes of the entries in sets, which maps attribute set ids to entries
+func (db *DB) loadAttributes(sets map[int][]*Entry) error {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	params := make([]interface{}, 0, len(sets))
+	for id := range sets {
+		params = append(params, id)
+	}
+	query := db.dialect.rebind(fmt.Sprintf(`
+		select
+			attribute_set_member.attribute_set_id,
+			attribute.name,
+			attribute.value
+		from attribute_set_member
+		inner join attribute on
+			attribute_set_member.attribute_id = attribute.id
+		where attribute_set_member.attribute_set_id in (%s)`, placeholders(len(params))))
+
+	rows, err := db.DB.Query(query, params...)
+	if err != nil {
+		return fmt.Errorf("could not query attributes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id          int
+			name, value string
+		)
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return fmt.Errorf("could not scan attribute: %w", err)
+		}
+		for _, e := range sets[id] {
+			if e.Attributes == nil {
+				e.Attributes = make(map[string]string)
+			}
+			e.Attributes[name] = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not scan attributes: %w", err)
+	}
+	return nil
+}
+
+// queryLastUser selects each device's latest entry by time, since backdated entries can be written after newer ones.
+// Ties are broken by id
+const queryLastUser = `
+select ` + entryColumns + `
+from (
+    select
+        max(log.id) as id
+    from (
+        select
+            device.serial,
+            max(log.time) as last_time
+        from device
+        inner join identity on device.id = identity.device_id
+        inner join "user" on "user".id = identity.user_id
+        inner join log on log.identity_id = identity.id
+        where
+            device.serial in (%[1]s) and
+            %[2]s
+        group by
+            device.serial
+    ) as latest
+    inner join device on device.serial = latest.serial
+    inner join identity on device.id = identity.device_id
+    inner join "user" on "user".id = identity.user_id
+    inner join log on log.identity_id = identity.id and log.time = latest.last_time
+    where
+        %[2]s
+    group by
+        latest.serial
+) as joined
+inner join log on
+    joined.id = log.id
+` + entryJoins
+
+// QueryLastUser returns the last information for serials, skipping accounts excluded by x.
+// If x is nil, DefaultExclusion is used
+func (db *DB) QueryLastUser(serials []string, x *Exclusion) ([]*Entry, error) {
+	params := make([]interface{}, len(serials))
+	for idx, s := range serials {
+		params[idx] = s
+	}
+	filter, filterParams := x.filter()
+	params = append(params, filterParams...)
+	params = append(params, filterParams...)
+	return db.queryEntries(fmt.Sprintf(queryLastUser, placeholders(len(serials)), filter), params...)
+}
+
+// AttributeQuery is a query for devices by attribute
+type AttributeQuery struct {
+	Key string `json:"key"`
+	// Value, if not nil, is the value the attribute must have
+	Value *string `json:"value,omitempty"`
+	// Limit is the maximum number of devices returned; default: DefaultQueryLimit
+	Limit int `json:"limit,omitempty"`
+	// Exclude is the accounts skipped when finding each device's latest entry; default: DefaultExclusion
+	Exclude *Exclusion `json:"exclude,omitempty"`
+}
+
+// Query limits
+const (
+	DefaultQueryLimit = 1000
+	MaxQueryLimit     = 10000
+)
+
+// queryAttribute selects each device's latest matching entry by time, breaking ties by id
+const queryAttribute = `
+select ` + entryColumns + `
+from (
+    select
+        max(log.id) as id
+    from (
+        select
+            device.serial,
+            max(log.time) as last_time
+        from attribute
+        inner join attribute_set_member on attribute.id = attribute_set_member.attribute_id
+        inner join log on attribute_set_member.attribute_set_id = log.attribute_set_id
+        inner join identity on log.identity_id = identity.id
+        inner join device on identity.device_id = device.id
+        inner join "user" on identity.user_id = "user".id
+        where
+            attribute.name = ? %[1]s and
+            %[2]s
+        group by
+            device.serial
+    ) as latest
+    inner join device on device.serial = latest.serial
+    inner join identity on device.id = identity.device_id
+    inner join "user" on identity.user_id = "user".id
+    inner join log on log.identity_id = identity.id and log.time = latest.last_time
+    inner join attribute_set_member on log.attribute_set_id = attribute_set_member.attribute_set_id
+    inner join attribute on attribute_set_member.attribute_id = attribute.id
+    where
+        attribute.name = ? %[1]s and
+        %[2]s
+    group by
+        latest.serial
+) as joined
+inner join log on
+    joined.id = log.id
+` + entryJoins + `
+order by log.time desc, log.id desc
+limit ?`
+
+// QueryAttribute returns the most recent entry with a matching attribute for each device, newest first.
+// Entries from accounts excluded by q.Exclude are skipped
+func (db *DB) QueryAttribute(q *AttributeQuery) ([]*Entry, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	params := []interface{}{q.Key}
+	var filter string
+	if q.Value != nil {
+		filter = "and attribute.value = ?"
+		params = append(params, *q.Value)
+	}
+	exclude, excludeParams := q.Exclude.filter()
+	params = append(params, excludeParams...)
+	//the filters are applied again to find the entry at each device's latest time
+	params = append(params, params...)
+	params = append(params, limit)
+
+	return db.queryEntries(fmt.Sprintf(queryAttribute, filter, exclude), params...)
+}
+
+// HistoryQuery is a query for the entries logged by a device
+type HistoryQuery struct {
+	Serial string `json:"serial"`
+	// Start and End, if not zero, limit the entries to Start <= time < End
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	// Limit is the maximum number of entries returned; default: DefaultQueryLimit
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page, if any
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// HistoryPage is a page of entries returned by QueryHistory.
+// NextCursor is empty if there are no more entries
+type HistoryPage struct {
+	Entries    []*Entry `json:"entries"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// Query errors
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrMissingAddress = errors.New("ip or internet_ip is required")
+)
+
+// encodeCursor returns an opaque cursor for the position after e
+func encodeCursor(e *Entry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(e.Time.UnixNano(), 10) + "." + strconv.FormatInt(e.logID, 10)))
+}
+
+// decodeCursor returns the time and log id encoded in cursor
+func decodeCursor(cursor string) (time.Time, int64, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	parts := strings.Split(string(buf), ".")
+	if len(parts) != 2 {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return time.Unix(0, nsec).UTC(), id, nil
+}
+
+const queryHistory = `
+select ` + entryColumns + `
+from log
+` + entryJoins + `
+where
+	device.serial = ? %s
+order by log.time, log.id
+limit ?`
+
+// QueryHistory returns a page of the entries logged by a device, oldest first
+func (db *DB) QueryHistory(q *HistoryQuery) (*HistoryPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	var filters []string
+	params := []interface{}{q.Serial}
+	if !q.Start.IsZero() {
+		filters = append(filters, "log.time >= ?")
+		params = append(params, q.Start.UTC())
+	}
+	if !q.End.IsZero() {
+		filters = append(filters, "log.time < ?")
+		params = append(params, q.End.UTC())
+	}
+	if q.Cursor != "" {
+		t, id, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, "(log.time > ? or (log.time = ? and log.id > ?))")
+		params = append(params, t, t, id)
+	}
+	var filter string
+	if len(filters) != 0 {
+		filter = "and " + strings.Join(filters, " and ")
+	}
+
+	//get an extra entry to check if there's another page
+	params = append(params, limit+1)
+	entries, err := db.queryEntries(fmt.Sprintf(queryHistory, filter), params...)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextCursor = encodeCursor(entries[limit-1])
+	}
+	if page.Entries == nil {
+		page.Entries = []*Entry{}
+	}
+	return page, nil
+}
+
+// IPMatch is an identity that was logged with a queried address near the queried time.
+// Entry is the identity's entry closest to the queried time.
+// Before and After are the identity's last entry at or before, and first entry after, the queried time within the tolerance window
+type IPMatch struct {
+	*Entry
+	Before    *time.Time `json:"before,omitempty"`
+	After     *time.Time `json:"after,omitempty"`
+	Bracketed bool       `json:"bracketed"`
+}
+
+// queryIP selects the entry nearest the queried time on one side of it for each identity logged with the queried address (%[1]s).
+// %[2]s and %[4]s are the side's time range for log and nearest, and %[3]s is the order (asc or desc) moving away from the queried time
+const queryIP = `
+select ` + entryColumns + `
+from log
+` + entryJoins + `
+where
+	%[1]s and
+	%[2]s and
+	log.id = (
+		select nearest.id from log as nearest
+		where
+			nearest.identity_id = log.identity_id and
+			%[4]s
+		order by nearest.time %[3]s, nearest.id %[3]s
+		limit 1
+	)
+order by log.time, log.id
+limit ?`
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// QueryIP returns the identities logged with ip and/or internetIP within tolerance of t.
+// Identities with entries on both sides of t are returned first, then the rest by how close their nearest entry is to t
+func (db *DB) QueryIP(ip, internetIP string, t time.Time, tolerance time.Duration) ([]*IPMatch, error) {
+	var (
+		filters []string
+		params  []interface{}
+	)
+	for _, a := range []struct {
+		field, column, value string
+	}{{"ip", "address.ip", ip}, {"internet_ip", "address.internetip", internetIP}} {
+		if a.value == "" {
+			continue
+		}
+		addr, err := parseIP(a.value)
+		if err != nil {
+			return nil, ValidationErrors{{Field: a.field, Reason: ReasonInvalidAddress}}
+		}
+		filters = append(filters, a.column+" = ?")
+		params = append(params, ipBytes(addr))
+	}
+	if len(filters) == 0 {
+		return nil, ErrMissingAddress
+	}
+
+	//query each identity's last entry at or before t and first entry after t separately,
+	//so a busy address can't push entries on either side out of the results
+	var entries []*Entry
+	for _, side := range []struct {
+		cond, order string
+		start, end  time.Time
+	}{
+		{"%[1]s.time >= ? and %[1]s.time <= ?", "desc", t.Add(-tolerance), t},
+		{"%[1]s.time > ? and %[1]s.time <= ?", "asc", t, t.Add(tolerance)},
+	} {
+		query := fmt.Sprintf(queryIP, strings.Join(filters, " and "), fmt.Sprintf(side.cond, "log"), side.order, fmt.Sprintf(side.cond, "nearest"))
+		sideParams := append(append([]interface{}{}, params...), side.start.UTC(), side.end.UTC(), side.start.UTC(), side.end.UTC(), MaxQueryLimit)
+		sideEntries, err := db.queryEntries(query, sideParams...)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, sideEntries...)
+	}
+
+	var (
+		matches    []*IPMatch
+		identities = make(map[Hash]*IPMatch)
+	)
+	for _, e := range entries {
+		_, _, _, h := e.Hashes()
+		m, ok := identities[h]
+		if !ok {
+			m = &IPMatch{Entry: e}
+			identities[h] = m
+			matches = append(matches, m)
+		}
+		et := e.Time
+		if !et.After(t) {
+			if m.Before == nil || et.After(*m.Before) {
+				m.Before = &et
+			}
+		} else if m.After == nil || et.Before(*m.After) {
+			m.After = &et
+		}
+		if absDuration(e.Time.Sub(t)) < absDuration(m.Entry.Time.Sub(t)) {
+			m.Entry = e
+		}
+	}
+
+	for _, m := range matches {
+		m.Bracketed = m.Before != nil && m.After != nil
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Bracketed != matches[j].Bracketed {
+			return matches[i].Bracketed
+		}
+		return absDuration(matches[i].Entry.Time.Sub(t)) < absDuration(matches[j].Entry.Time.Sub(t))
+	})
+
+	return matches, nil
+}
+
+// aggregateTime is a sql.Scanner for times returned by aggregate functions, which sqlite returns as strings
+type aggregateTime struct {
+	time.Time
+}
+
+// aggregateTimeFormats are the formats aggregate times may be returned as
+var aggregateTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999-07:00",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+}
+
+func (t *aggregateTime) Scan(v interface{}) error {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("could not scan %T into time", v)
+	}
+	for _, f := range aggregateTimeFormats {
+		if parsed, err := time.Parse(f, s); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("could not parse time: %s", s)
+}
+
+// UserQuery is a query for the devices a user has logged in from
+type UserQuery struct {
+	// Username, if not empty, must match exactly
+	Username string `json:"username,omitempty"`
+	// FullName, if not empty, must be contained in the user's full name, ignoring case
+	FullName string `json:"full_name,omitempty"`
+	// Limit is the maximum number of results; default: DefaultQueryLimit
+	Limit int `json:"limit,omitempty"`
+}
+
+// UserDevice is a device a user has logged in from
+type UserDevice struct {
+	UID              uint32    `json:"uid"`
+	Username         string    `json:"username"`
+	FullName         string    `json:"full_name"`
+	Serial           string    `json:"serial"`
+	ClientIdentifier string    `json:"client_identifier"`
+	Hostname         string    `json:"hostname"`
+	FirstSeen        time.Time `json:"first_seen"`
+	LastSeen         time.Time `json:"last_seen"`
+	CheckIns         int64     `json:"check_ins"`
+}
+
+// ErrMissingUser is returned by QueryUser if neither a username or full name is given
+var ErrMissingUser = errors.New("username or full_name is required")
+
+// likeEscaper escapes the wildcards in a LIKE pattern with !
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+const queryUser = `
+select
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	device.serial,
+	device.clientidentifier,
+	device.hostname,
+	min(log.time),
+	max(log.time),
+	count(*)
+from "user"
+inner join identity on
+	"user".id = identity.user_id
+inner join device on
+	identity.device_id = device.id
+inner join log on
+	identity.id = log.identity_id
+where
+	%s
+group by
+	"user".id,
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	device.id,
+	device.serial,
+	device.clientidentifier,
+	device.hostname
+order by max(log.time) desc
+limit ?`
+
+// QueryUser returns the devices matching users have logged in from, most recently seen first
+func (db *DB) QueryUser(q *UserQuery) ([]*UserDevice, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	var (
+		filters []string
+		params  []interface{}
+	)
+	if q.Username != "" {
+		filters = append(filters, `"user".username = ?`)
+		params = append(params, q.Username)
+	}
+	if q.FullName != "" {
+		filters = append(filters, `lower("user".fullname) like ? escape '!'`)
+		params = append(params, "%"+likeEscaper.Replace(strings.ToLower(q.FullName))+"%")
+	}
+	if len(filters) == 0 {
+		return nil, ErrMissingUser
+	}
+	params = append(params, limit)
+
+	rows, err := db.DB.Query(db.dialect.rebind(fmt.Sprintf(queryUser, strings.Join(filters, " and "))), params...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []*UserDevice{}
+	for rows.Next() {
+		d := new(UserDevice)
+		var first, last aggregateTime
+		if err := rows.Scan(&d.UID, &d.Username, &d.FullName, &d.Serial, &d.ClientIdentifier, &d.Hostname,
+			&first, &last, &d.CheckIns); err != nil {
+			return nil, fmt.Errorf("could not scan row: %w", err)
+		}
+		d.FirstSeen, d.LastSeen = first.Time, last.Time
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan rows: %w", err)
+	}
+	return devices, nil
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// StaleDevice is a device that hasn't logged an entry since a report's cutoff.
+// Everything but LastSeen is from the device's most recently written entry
+type StaleDevice struct {
+	Serial           string    `json:"serial"`
+	ClientIdentifier string    `json:"client_identifier"`
+	Hostname         string    `json:"hostname"`
+	UID              uint32    `json:"uid"`
+	Username         string    `json:"username"`
+	FullName         string    `json:"full_name"`
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+// StaleGroup is the stale devices with the same ClientIdentifier
+type StaleGroup struct {
+	ClientIdentifier string         `json:"client_identifier"`
+	Devices          []*StaleDevice `json:"devices"`
+}
+
+// StaleReport is a list of stale devices grouped by ClientIdentifier
+type StaleReport []*StaleGroup
+
+// staleHeader is the header row written by StaleReport.WriteCSV
+var staleHeader = []string{"client_identifier", "serial", "hostname", "uid", "username", "full_name", "last_seen"}
+
+// WriteCSV writes the report to w as CSV with a header row and one row per device
+func (r StaleReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(staleHeader); err != nil {
+		return fmt.Errorf("could not write csv: %w", err)
+	}
+	for _, g := range r {
+		for _, d := range g.Devices {
+			if err := cw.Write([]string{
+				d.ClientIdentifier, d.Serial, d.Hostname, strconv.FormatUint(uint64(d.UID), 10),
+				d.Username, d.FullName, d.LastSeen.UTC().Format(time.RFC3339),
+			}); err != nil {
+				return fmt.Errorf("could not write csv: %w", err)
+			}
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("could not write csv: %w", err)
+	}
+	return nil
+}
+
+// queryStale selects each stale device's latest entry by time, breaking ties by id, so the entry matches last_seen
+const queryStale = `
+select
+	device.serial,
+	device.clientidentifier,
+	device.hostname,
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	stale.last_seen
+from (
+    select
+        max(log.id) as id,
+        latest.last_seen
+    from (
+        select
+            device.serial,
+            max(log.time) as last_seen
+        from device
+        inner join identity on device.id = identity.device_id
+        inner join log on log.identity_id = identity.id
+        group by
+            device.serial
+        having
+            max(log.time) < ?
+    ) as latest
+    inner join device on device.serial = latest.serial
+    inner join identity on device.id = identity.device_id
+    inner join log on log.identity_id = identity.id and log.time = latest.last_seen
+    group by
+        latest.serial,
+        latest.last_seen
+) as stale
+inner join log on
+    stale.id = log.id
+inner join identity on
+    log.identity_id = identity.id
+inner join device on
+    identity.device_id = device.id
+inner join "user" on
+    identity.user_id = "user".id
+order by device.clientidentifier, stale.last_seen, device.serial`
+
+// QueryStale returns the devices that haven't logged an entry since before, grouped by ClientIdentifier.
+// Groups are sorted by ClientIdentifier, and devices in each group by LastSeen, oldest first
+func (db *DB) QueryStale(before time.Time) (StaleReport, error) {
+	rows, err := db.DB.Query(db.dialect.rebind(queryStale), before.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+	defer rows.Close()
+
+	report := StaleReport{}
+	var group *StaleGroup
+	for rows.Next() {
+		d := new(StaleDevice)
+		var lastSeen aggregateTime
+		if err := rows.Scan(&d.Serial, &d.ClientIdentifier, &d.Hostname, &d.UID, &d.Username, &d.FullName, &lastSeen); err != nil {
+			return nil, fmt.Errorf("could not scan row: %w", err)
+		}
+		d.LastSeen = lastSeen.Time
+
+		if group == nil || group.ClientIdentifier != d.ClientIdentifier {
+			group = &StaleGroup{ClientIdentifier: d.ClientIdentifier}
+			report = append(report, group)
+		}
+		group.Devices = append(group.Devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan rows: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStaleReportWriteCSV(t *testing.T) {
+	report := StaleReport{
+		{ClientIdentifier: "com.example.chronicle", Devices: []*StaleDevice{
+			{Serial: "SERIAL1", ClientIdentifier: "com.example.chronicle", Hostname: "host1", UID: 501, Username: "alice", FullName: "Smith, Alice",
+				LastSeen: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		}},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := report.WriteCSV(buf); err != nil {
+		t.Fatal("could not write csv:", err)
+	}
+	expected := "client_identifier,serial,hostname,uid,username,full_name,last_seen\n" +
+		"com.example.chronicle,SERIAL1,host1,501,alice,\"Smith, Alice\",2024-01-01T12:00:00Z\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session is a period an identity was in use, made from consecutive check-ins with no more than the session gap between them
+type Session struct {
+	UID              uint32    `json:"uid"`
+	Username         string    `json:"username"`
+	FullName         string    `json:"full_name"`
+	Serial           string    `json:"serial"`
+	ClientIdentifier string    `json:"client_identifier"`
+	Hostname         string    `json:"hostname"`
+	IP               string    `json:"ip"`
+	InternetIP       string    `json:"internet_ip"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	CheckIns         int       `json:"check_ins"`
+}
+
+// sessionRun is a session being merged into the session table
+type sessionRun struct {
+	id         int64
+	identityID int
+	start, end time.Time
+	checkIns   int
+}
+
+// collapseSessions collapses the log entries of inses into runs of check-ins by the same identity with no more than gap between them
+func collapseSessions(inses []*Insert, gap time.Duration) []*sessionRun {
+	times := make(map[int][]time.Time)
+	for _, ins := range inses {
+		times[ins.IdentityID] = append(times[ins.IdentityID], ins.LogEntry.Time.UTC())
+	}
+
+	var runs []*sessionRun
+	for id, ts := range times {
+		sort.Slice(ts, func(i, j int) bool { return ts[i].Before(ts[j]) })
+		var run *sessionRun
+		for _, t := range ts {
+			if run != nil && t.Sub(run.end) <= gap {
+				run.end = t
+				run.checkIns++
+				continue
+			}
+			run = &sessionRun{identityID: id, start: t, end: t, checkIns: 1}
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].identityID != runs[j].identityID {
+			return runs[i].identityID < runs[j].identityID
+		}
+		return runs[i].start.Before(runs[j].start)
+	})
+	return runs
+}
+
+// mergeSession merges run with the identity's sessions within db.sessionGap of it, inserting a new session if there are none
+func (db *DB) mergeSession(tx *sql.Tx, run *sessionRun) error {
+	rows, err := tx.Query(db.dialect.rebind(`
+		SELECT id, start_time, end_time, check_ins FROM session
+		WHERE identity_id=? AND end_time >= ? AND start_time <= ?
+		ORDER BY start_time, id`),
+		run.identityID, run.start.Add(-db.sessionGap), run.end.Add(db.sessionGap))
+	if err != nil {
+		return fmt.Errorf("could not query sessions: %w", err)
+	}
+	var existing []*sessionRun
+	for rows.Next() {
+		s := new(sessionRun)
+		if err = rows.Scan(&(s.id), &(s.start), &(s.end), &(s.checkIns)); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan session: %w", err)
+		}
+		existing = append(existing, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not scan sessions: %w", err)
+	}
+
+	if len(existing) == 0 {
+		if _, err = tx.Exec(db.dialect.rebind("INSERT INTO session(identity_id, start_time, end_time, check_ins) VALUES(?, ?, ?, ?)"),
+			run.identityID, run.start, run.end, run.checkIns); err != nil {
+			return fmt.Errorf("could not insert session: %w", err)
+		}
+		return nil
+	}
+
+	//extend the first session to cover run and any later sessions run bridges the gap to, then delete the later sessions
+	merged := existing[0]
+	for _, s := range append(existing[1:], run) {
+		if s.start.Before(merged.start) {
+			merged.start = s.start
+		}
+		if s.end.After(merged.end) {
+			merged.end = s.end
+		}
+		merged.checkIns += s.checkIns
+	}
+	if _, err = tx.Exec(db.dialect.rebind("UPDATE session SET start_time=?, end_time=?, check_ins=? WHERE id=?"),
+		merged.start.UTC(), merged.end.UTC(), merged.checkIns, merged.id); err != nil {
+		return fmt.Errorf("could not update session: %w", err)
+	}
+	for _, s := range existing[1:] {
+		if _, err = tx.Exec(db.dialect.rebind("DELETE FROM session WHERE id=?"), s.id); err != nil {
+			return fmt.Errorf("could not delete session: %w", err)
+		}
+	}
+	return nil
+}
+
+// updateSessions merges the log entries of inses into the session table
+func (db *DB) updateSessions(tx *sql.Tx, inses []*Insert) error {
+	for _, run := range collapseSessions(inses, db.sessionGap) {
+		if err := db.mergeSession(tx, run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionQuery is a query for sessions
+type SessionQuery struct {
+	// Serial and Username, if not empty, must match exactly
+	Serial   string `json:"serial,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Start and End, if not zero, limit the sessions to those overlapping Start <= time < End
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	// Limit is the maximum number of sessions returned; default: DefaultQueryLimit
+	Limit int `json:"limit,omitempty"`
+}
+
+const querySessions = `
+select
+	"user".uid,
+	"user".username,
+	"user".fullname,
+	device.serial,
+	device.clientidentifier,
+	device.hostname,
+	address.ip,
+	address.internetip,
+	session.start_time,
+	session.end_time,
+	session.check_ins
+from session
+inner join identity on
+	session.identity_id = identity.id
+inner join device on
+	identity.device_id = device.id
+inner join "user" on
+	identity.user_id = "user".id
+inner join address on
+	identity.address_id = address.id
+%s
+order by session.start_time desc, session.id desc
+limit ?`
+
+// QuerySessions returns the matching sessions, most recently started first
+func (db *DB) QuerySessions(q *SessionQuery) ([]*Session, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	var (
+		filters []string
+		params  []interface{}
+	)
+	if q.Serial != "" {
+		filters = append(filters, "device.serial = ?")
+		params = append(params, q.Serial)
+	}
+	if q.Username != "" {
+		filters = append(filters, `"user".username = ?`)
+		params = append(params, q.Username)
+	}
+	if !q.Start.IsZero() {
+		filters = append(filters, "session.end_time >= ?")
+		params = append(params, q.Start.UTC())
+	}
+	if !q.End.IsZero() {
+		filters = append(filters, "session.start_time < ?")
+		params = append(params, q.End.UTC())
+	}
+	params = append(params, limit)
+
+	var where string
+	if len(filters) > 0 {
+		where = "where " + strings.Join(filters, " and ")
+	}
+
+	rows, err := db.DB.Query(db.dialect.rebind(fmt.Sprintf(querySessions, where)), params...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		s := new(Session)
+		var ip, internetIP []byte
+		if err := rows.Scan(&s.UID, &s.Username, &s.FullName, &s.Serial, &s.ClientIdentifier, &s.Hostname,
+			&ip, &internetIP, &s.Start, &s.End, &s.CheckIns); err != nil {
+			return nil, fmt.Errorf("could not scan row: %w", err)
+		}
+		s.IP, s.InternetIP = ipString(ip), ipString(internetIP)
+		s.Start, s.End = s.Start.UTC(), s.End.UTC()
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan rows: %w", err)
+	}
+	return sessions, nil
+}
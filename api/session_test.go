@@ -0,0 +1,28 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollapseSessions(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	at := func(identityID int, minutes int) *Insert {
+		return &Insert{IdentityID: identityID, LogEntry: &LogEntry{Time: start.Add(time.Duration(minutes) * time.Minute)}}
+	}
+
+	runs := collapseSessions([]*Insert{at(1, 30), at(2, 0), at(1, 0), at(1, 15), at(1, 90), at(2, 30)}, 30*time.Minute)
+	expected := []sessionRun{
+		{identityID: 1, start: start, end: start.Add(30 * time.Minute), checkIns: 3},
+		{identityID: 1, start: start.Add(90 * time.Minute), end: start.Add(90 * time.Minute), checkIns: 1},
+		{identityID: 2, start: start, end: start.Add(30 * time.Minute), checkIns: 2},
+	}
+	if len(runs) != len(expected) {
+		t.Fatalf("expected %d runs, got %d", len(expected), len(runs))
+	}
+	for idx, run := range runs {
+		if e := expected[idx]; run.identityID != e.identityID || !run.start.Equal(e.start) || !run.end.Equal(e.end) || run.checkIns != e.checkIns {
+			t.Errorf("run %d: expected %#v, got %#v", idx, e, *run)
+		}
+	}
+}
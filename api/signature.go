@@ -0,0 +1,140 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SignatureMode is what's done with submit requests that aren't signed.
+// Requests with invalid, expired, or replayed signatures are always rejected
+type SignatureMode string
+
+// Signature modes
+const (
+	// SignatureModeAccept accepts unsigned requests
+	SignatureModeAccept SignatureMode = "accept"
+	// SignatureModeFlag accepts unsigned requests, setting SignatureAttribute on their entries
+	SignatureModeFlag SignatureMode = "flag"
+	// SignatureModeReject rejects unsigned requests
+	SignatureModeReject SignatureMode = "reject"
+)
+
+// ParseSignatureMode parses a SignatureMode. An empty string is SignatureModeAccept
+func ParseSignatureMode(s string) (SignatureMode, error) {
+	switch m := SignatureMode(s); m {
+	case "":
+		return SignatureModeAccept, nil
+	case SignatureModeAccept, SignatureModeFlag, SignatureModeReject:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown signature mode: %s", s)
+}
+
+// Signature request headers. SignatureKeyHeader is optional and defaults to DefaultSigningKey
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureKeyHeader       = "X-Signature-Key"
+)
+
+// DefaultSigningKey is the name of the key used for requests without a SignatureKeyHeader
+const DefaultSigningKey = "default"
+
+// SignatureAttribute is the attribute set to missing on entries from unsigned requests in SignatureModeFlag.
+// Submitted values for it are always removed
+const SignatureAttribute = "chronicle.signature"
+
+// defaultSignatureWindow is how far a signature's timestamp can be from the current time if not configured
+const defaultSignatureWindow = 5 * time.Minute
+
+// Sign returns the hex HMAC-SHA256 signature of timestamp (in Unix seconds) and body with key.
+// The signed message is the decimal timestamp, a period, then the body
+func Sign(key []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier verifies HMAC-SHA256 request signatures with a set of named keys.
+// Signatures with a timestamp more than the window from the current time are rejected,
+// and signatures are remembered for the window so they can't be replayed
+type Verifier struct {
+	keys   map[string][]byte
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextPrune time.Time
+}
+
+// NewVerifier returns a new Verifier for keys, by name, with the given replay window; default: 5 minutes
+func NewVerifier(keys map[string]string, window time.Duration) *Verifier {
+	if window <= 0 {
+		window = defaultSignatureWindow
+	}
+	v := &Verifier{keys: make(map[string][]byte), window: window, seen: make(map[string]time.Time)}
+	for name, key := range keys {
+		v.keys[name] = []byte(key)
+	}
+	return v
+}
+
+// Verify checks the signature of r, whose body is body, at now.
+// signed is false if r doesn't have a signature. A ValidationError is returned if the signature isn't valid
+func (v *Verifier) Verify(r *http.Request, body []byte, now time.Time) (signed bool, vErr *ValidationError) {
+	sig := r.Header.Get(SignatureHeader)
+	if sig == "" {
+		return false, nil
+	}
+
+	name := r.Header.Get(SignatureKeyHeader)
+	if name == "" {
+		name = DefaultSigningKey
+	}
+	key, ok := v.keys[name]
+	if !ok {
+		return true, &ValidationError{Field: "signature", Reason: ReasonInvalidKey}
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return true, &ValidationError{Field: "timestamp", Reason: ReasonMissing}
+	}
+	if !hmac.Equal([]byte(sig), []byte(Sign(key, ts, body))) {
+		return true, &ValidationError{Field: "signature", Reason: ReasonInvalidSignature}
+	}
+
+	t := time.Unix(ts, 0)
+	switch {
+	case t.After(now.Add(v.window)):
+		return true, &ValidationError{Field: "timestamp", Reason: ReasonInFuture}
+	case t.Before(now.Add(-v.window)):
+		return true, &ValidationError{Field: "timestamp", Reason: ReasonTooOld}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.After(v.nextPrune) {
+		for s, expires := range v.seen {
+			if now.After(expires) {
+				delete(v.seen, s)
+			}
+		}
+		v.nextPrune = now.Add(v.window)
+	}
+	id := name + ":" + sig
+	if _, ok := v.seen[id]; ok {
+		return true, &ValidationError{Field: "signature", Reason: ReasonReplayed}
+	}
+	v.seen[id] = t.Add(v.window)
+
+	return true, nil
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier(map[string]string{DefaultSigningKey: "secret", "site1": "other"}, time.Minute)
+	body := []byte(`{"serial": "SERIAL1"}`)
+	now := time.Unix(1704067200, 0)
+
+	request := func(key, name string, ts int64, signed []byte) *http.Request {
+		r := httptest.NewRequest("POST", "/api/v2/submit", bytes.NewReader(body))
+		r.Header.Set(SignatureTimestampHeader, strconv.FormatInt(ts, 10))
+		r.Header.Set(SignatureHeader, Sign([]byte(key), ts, signed))
+		if name != "" {
+			r.Header.Set(SignatureKeyHeader, name)
+		}
+		return r
+	}
+
+	if signed, vErr := v.Verify(httptest.NewRequest("POST", "/api/v2/submit", nil), body, now); signed || vErr != nil {
+		t.Errorf("expected unsigned request, got %v, %v", signed, vErr)
+	}
+
+	for _, test := range []struct {
+		name    string
+		r       *http.Request
+		reason  string
+		advance time.Duration
+	}{
+		{"default key", request("secret", "", now.Unix(), body), "", 0},
+		{"site key", request("other", "site1", now.Unix(), body), "", 0},
+		{"replayed", request("secret", "", now.Unix(), body), ReasonReplayed, 0},
+		{"unknown key", request("secret", "site2", now.Unix(), body), ReasonInvalidKey, 0},
+		{"wrong key", request("other", "", now.Unix(), body), ReasonInvalidSignature, 0},
+		{"modified body", request("secret", "", now.Unix()+1, []byte(`{"serial": "SERIAL2"}`)), ReasonInvalidSignature, 0},
+		{"too old", request("secret", "", now.Unix()-120, body), ReasonTooOld, 0},
+		{"in future", request("secret", "", now.Unix()+120, body), ReasonInFuture, 0},
+		{"within window", request("secret", "", now.Unix()+30, body), "", 0},
+		{"replayed after prune", request("secret", "", now.Unix()+30, body), ReasonReplayed, 80 * time.Second},
+	} {
+		signed, vErr := v.Verify(test.r, body, now.Add(test.advance))
+		if !signed {
+			t.Errorf("%s: expected signed request", test.name)
+		}
+		if test.reason == "" && vErr != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, vErr)
+		}
+		if test.reason != "" && (vErr == nil || vErr.Reason != test.reason) {
+			t.Errorf("%s: expected %s, got %v", test.name, test.reason, vErr)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spoolExt is the extension of segment files, and ackExt of the files recording which of a segment's entries are committed
+const (
+	spoolExt = ".spool"
+	ackExt   = ".ack"
+)
+
+// spoolRef is the position of an entry in the Spool
+type spoolRef struct {
+	segment int64
+	//line number of the entry in segment
+	index int
+}
+
+// ErrSpoolClosed is returned by Spool methods after the Spool is closed
+var ErrSpoolClosed = errors.New("spool closed")
+
+// Spool is an append-only, on-disk log of entries that haven't been committed to the database yet.
+// Entries are appended to numbered segment files as JSON lines. As entries are committed, their line numbers are appended to the segment's ack file,
+// and a segment is deleted once every entry in it has been committed.
+// Segments left over from a previous run are read again when the Spool is opened, skipping entries that were already committed
+type Spool struct {
+	dir string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	//stopped is set by Stop and Close, and closed by Close
+	stopped bool
+	closed  bool
+
+	//active segment
+	w        *os.File
+	active   int64
+	appended int
+
+	//uncommitted entries per segment
+	pending map[int64]int
+
+	//segments not yet fully read by Next
+	unread []int64
+
+	//line numbers of committed entries in segments left over from a previous run
+	acked map[int64]map[int]bool
+
+	//Next's state; only used by the reader
+	r        *bufio.Reader
+	rf       *os.File
+	reading  int64
+	readFrom int
+	line     int
+	offset   int64
+	skip     map[int]bool
+}
+
+func segmentName(dir string, segment int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", segment, spoolExt))
+}
+
+func ackName(dir string, segment int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", segment, ackExt))
+}
+
+// readAcks returns the line numbers of committed entries in segment's ack file at path, or nil if it doesn't exist.
+// A torn last line is ignored
+func readAcks(path string) (map[int]bool, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	acked := make(map[int]bool)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if idx, err := strconv.Atoi(line); err == nil {
+			acked[idx] = true
+		}
+	}
+	return acked, nil
+}
+
+// countSegment returns the number of valid entries in the segment at path whose line numbers aren't in acked
+func countSegment(path string, acked map[int]bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n, idx int
+	r := bufio.NewReader(f)
+	for ; ; idx++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && !acked[idx] && json.Unmarshal(line, new(Entry)) == nil {
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// remove deletes segment and its ack file
+func (s *Spool) remove(segment int64) error {
+	if err := os.Remove(segmentName(s.dir, segment)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove spool segment %d: %w", segment, err)
+	}
+	if err := os.Remove(ackName(s.dir, segment)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove spool segment %d acks: %w", segment, err)
+	}
+	return nil
+}
+
+// OpenSpool opens the Spool in dir, creating dir if it doesn't exist
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir, pending: make(map[int64]int), acked: make(map[int64]map[int]bool)}
+	s.cond = sync.NewCond(&s.mu)
+
+	var total int
+	for _, f := range files {
+		//remove ack files left without their segment
+		if strings.HasSuffix(f.Name(), ackExt) {
+			segment, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ackExt), 10, 64)
+			if _, sErr := os.Stat(segmentName(dir, segment)); err == nil && os.IsNotExist(sErr) {
+				os.Remove(ackName(dir, segment))
+			}
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), spoolExt) {
+			continue
+		}
+		segment, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if segment > s.active {
+			s.active = segment
+		}
+
+		acked, err := readAcks(ackName(dir, segment))
+		if err != nil {
+			return nil, fmt.Errorf("could not read spool segment %d acks: %w", segment, err)
+		}
+		n, err := countSegment(segmentName(dir, segment), acked)
+		if err != nil {
+			return nil, fmt.Errorf("could not read spool segment %d: %w", segment, err)
+		}
+		if n == 0 {
+			if err = s.remove(segment); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.pending[segment] = n
+		if acked != nil {
+			s.acked[segment] = acked
+		}
+		s.unread = append(s.unread, segment)
+		total += n
+	}
+	sort.Slice(s.unread, func(i, j int) bool { return s.unread[i] < s.unread[j] })
+
+	if total > 0 {
+		log.Println("Replaying", total, "spooled entries")
+	}
+
+	if err = s.create(s.active + 1); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// create creates and activates a new segment. s.mu must be held
+func (s *Spool) create(segment int64) error {
+	f, err := os.OpenFile(segmentName(s.dir, segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create spool segment: %w", err)
+	}
+	s.w = f
+	s.active = segment
+	s.appended = 0
+	s.unread = append(s.unread, segment)
+	return nil
+}
+
+// Append durably writes entries to the active segment. The segment is synced once for all of them,
+// so appending a batch of entries together is much faster than appending them one at a time
+func (s *Spool) Append(entries ...*Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("could not encode entry: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSpoolClosed
+	}
+
+	if _, err := s.w.Write(buf); err != nil {
+		return fmt.Errorf("could not write spool: %w", err)
+	}
+	if err := s.w.Sync(); err != nil {
+		return fmt.Errorf("could not sync spool: %w", err)
+	}
+
+	s.appended += len(entries)
+	s.pending[s.active] += len(entries)
+	s.cond.Broadcast()
+
+	return nil
+}
+
+// Next returns the next entry from the Spool, blocking until one is available.
+// Next must only be called from a single goroutine. ErrSpoolClosed is returned once the Spool is stopped or closed.
+// If reading a segment fails, Next can be called again to retry from the same entry
+func (s *Spool) Next() (*Entry, error) {
+	for {
+		s.mu.Lock()
+		for !s.stopped && len(s.unread) == 1 && s.reading == s.active && s.readFrom == s.appended {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.mu.Unlock()
+			if s.rf != nil {
+				s.rf.Close()
+				s.rf = nil
+			}
+			return nil, ErrSpoolClosed
+		}
+		segment, rotated := s.unread[0], len(s.unread) > 1
+		s.mu.Unlock()
+
+		if s.rf == nil || s.reading != segment {
+			if s.rf != nil {
+				s.rf.Close()
+				s.rf = nil
+			}
+			f, err := os.Open(segmentName(s.dir, segment))
+			if err != nil {
+				return nil, fmt.Errorf("could not open spool segment %d: %w", segment, err)
+			}
+			if segment == s.reading {
+				//resume after a failed read
+				if _, err = f.Seek(s.offset, io.SeekStart); err != nil {
+					f.Close()
+					return nil, fmt.Errorf("could not seek spool segment %d: %w", segment, err)
+				}
+				s.rf, s.r = f, bufio.NewReader(f)
+			} else {
+				s.mu.Lock()
+				s.skip = s.acked[segment]
+				s.mu.Unlock()
+				s.rf, s.r, s.reading, s.readFrom, s.line, s.offset = f, bufio.NewReader(f), segment, 0, 0, 0
+			}
+		}
+
+		line, err := s.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			//reopen the segment on the next call, since part of a line may have been read
+			s.rf.Close()
+			s.rf = nil
+			return nil, fmt.Errorf("could not read spool segment %d: %w", segment, err)
+		}
+		s.offset += int64(len(line))
+
+		if len(line) > 0 {
+			idx := s.line
+			s.line++
+			e := new(Entry)
+			if jErr := json.Unmarshal(line, e); jErr != nil {
+				log.Println("Skipping invalid spool entry in segment", segment, ":", jErr)
+			} else if !s.skip[idx] {
+				s.mu.Lock()
+				s.readFrom++
+				s.mu.Unlock()
+				e.spooled = spoolRef{segment: segment, index: idx}
+				return e, nil
+			}
+		}
+
+		//finished reading a rotated segment
+		if err == io.EOF && rotated {
+			s.mu.Lock()
+			s.unread = s.unread[1:]
+			delete(s.acked, segment)
+			s.mu.Unlock()
+			s.rf.Close()
+			s.rf = nil
+		}
+	}
+}
+
+// Ack marks entries read from the Spool as committed. Their line numbers are durably appended to their segments' ack files
+// so they aren't replayed, and a segment is deleted once all of its entries are committed.
+// Ack may be called after the Spool is stopped, but not after it's closed
+func (s *Spool) Ack(refs ...spoolRef) error {
+	bySegment := make(map[int64][]int)
+	var segments []int64
+	for _, ref := range refs {
+		if _, ok := bySegment[ref.segment]; !ok {
+			segments = append(segments, ref.segment)
+		}
+		bySegment[ref.segment] = append(bySegment[ref.segment], ref.index)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	for _, segment := range segments {
+		indexes := bySegment[segment]
+		s.pending[segment] -= len(indexes)
+		if s.pending[segment] <= 0 && (segment != s.active || s.stopped) {
+			delete(s.pending, segment)
+			if err := s.remove(segment); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.writeAcks(segment, indexes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAcks appends indexes to segment's ack file and syncs it. s.mu must be held
+func (s *Spool) writeAcks(segment int64, indexes []int) error {
+	var buf []byte
+	for _, idx := range indexes {
+		buf = strconv.AppendInt(buf, int64(idx), 10)
+		buf = append(buf, '\n')
+	}
+
+	f, err := os.OpenFile(ackName(s.dir, segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open spool segment %d acks: %w", segment, err)
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write spool segment %d acks: %w", segment, err)
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync spool segment %d acks: %w", segment, err)
+	}
+	return f.Close()
+}
+
+// Rotate starts a new active segment if any entries were appended to the current one
+func (s *Spool) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSpoolClosed
+	}
+	if s.appended == 0 {
+		return nil
+	}
+
+	if err := s.w.Close(); err != nil {
+		return fmt.Errorf("could not close spool segment: %w", err)
+	}
+	old := s.active
+	if err := s.create(old + 1); err != nil {
+		return err
+	}
+	s.cond.Broadcast()
+
+	if s.pending[old] == 0 {
+		delete(s.pending, old)
+		if err := s.remove(old); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of uncommitted entries in the Spool
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, p := range s.pending {
+		n += p
+	}
+	return n
+}
+
+// Stop stops appending and reading entries, so Next returns ErrSpoolClosed. Entries that were already read can still be acked
+func (s *Spool) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.cond.Broadcast()
+}
+
+// Close stops and closes the Spool. Uncommitted entries are kept on disk and read again the next time the Spool is opened
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.stopped, s.closed = true, true
+	s.cond.Broadcast()
+
+	err := s.w.Close()
+	if s.pending[s.active] == 0 {
+		delete(s.pending, s.active)
+		if rErr := s.remove(s.active); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+	return err
+}
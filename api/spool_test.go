@@ -0,0 +1,300 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		t.Fatal("could not list spool:", err)
+	}
+	return files
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+
+	for _, serial := range []string{"SERIAL1", "SERIAL2"} {
+		if err = s.Append(&Entry{Serial: serial}); err != nil {
+			t.Fatal("could not append:", err)
+		}
+	}
+	if err = s.Rotate(); err != nil {
+		t.Fatal("could not rotate:", err)
+	}
+	if err = s.Append(&Entry{Serial: "SERIAL3"}); err != nil {
+		t.Fatal("could not append:", err)
+	}
+
+	var read []*Entry
+	for _, serial := range []string{"SERIAL1", "SERIAL2", "SERIAL3"} {
+		e, err := s.Next()
+		if err != nil {
+			t.Fatal("could not read spool:", err)
+		}
+		if e.Serial != serial {
+			t.Errorf("expected %s, got %s", serial, e.Serial)
+		}
+		read = append(read, e)
+	}
+
+	//first segment is fully committed and removed
+	if err = s.Ack(read[0].spooled, read[1].spooled); err != nil {
+		t.Fatal("could not ack:", err)
+	}
+	if files := spoolFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected 1 segment, got %v", files)
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("expected 1 pending entry, got %d", n)
+	}
+
+	//Next blocks until an entry is appended
+	next := make(chan *Entry)
+	go func() {
+		e, _ := s.Next()
+		next <- e
+	}()
+	select {
+	case <-next:
+		t.Fatal("expected Next to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s.Append(&Entry{Serial: "SERIAL4"}); err != nil {
+		t.Fatal("could not append:", err)
+	}
+	if e := <-next; e == nil || e.Serial != "SERIAL4" {
+		t.Errorf("expected SERIAL4, got %v", e)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal("could not close spool:", err)
+	}
+	if _, err = s.Next(); err != ErrSpoolClosed {
+		t.Errorf("expected ErrSpoolClosed, got %v", err)
+	}
+
+	//uncommitted entries are replayed
+	if s, err = OpenSpool(dir); err != nil {
+		t.Fatal("could not reopen spool:", err)
+	}
+	defer s.Close()
+	if n := s.Len(); n != 2 {
+		t.Errorf("expected 2 pending entries, got %d", n)
+	}
+	for _, serial := range []string{"SERIAL3", "SERIAL4"} {
+		e, err := s.Next()
+		if err != nil {
+			t.Fatal("could not read spool:", err)
+		}
+		if e.Serial != serial {
+			t.Errorf("expected %s, got %s", serial, e.Serial)
+		}
+	}
+}
+
+func TestSpoolAppendBatch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+	defer s.Close()
+
+	if err = s.Append(&Entry{Serial: "SERIAL1"}, &Entry{Serial: "SERIAL2"}, &Entry{Serial: "SERIAL3"}); err != nil {
+		t.Fatal("could not append:", err)
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("expected 3 pending entries, got %d", n)
+	}
+	for idx, serial := range []string{"SERIAL1", "SERIAL2", "SERIAL3"} {
+		e, err := s.Next()
+		if err != nil {
+			t.Fatal("could not read spool:", err)
+		}
+		if e.Serial != serial || e.spooled.index != idx {
+			t.Errorf("expected %s at line %d, got %s at line %d", serial, idx, e.Serial, e.spooled.index)
+		}
+	}
+}
+
+func TestSpoolTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(segmentName(dir, 1), []byte(`{"serial":"SERIAL1"}`+"\n"+`{"serial":"SER`), 0600); err != nil {
+		t.Fatal("could not write segment:", err)
+	}
+
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+	defer s.Close()
+
+	if n := s.Len(); n != 1 {
+		t.Errorf("expected 1 pending entry, got %d", n)
+	}
+	e, err := s.Next()
+	if err != nil {
+		t.Fatal("could not read spool:", err)
+	}
+	if e.Serial != "SERIAL1" {
+		t.Errorf("expected SERIAL1, got %s", e.Serial)
+	}
+}
+
+func TestSpoolCrashReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+
+	var read []*Entry
+	for _, serial := range []string{"SERIAL1", "SERIAL2", "SERIAL3"} {
+		if err = s.Append(&Entry{Serial: serial}); err != nil {
+			t.Fatal("could not append:", err)
+		}
+		e, err := s.Next()
+		if err != nil {
+			t.Fatal("could not read spool:", err)
+		}
+		read = append(read, e)
+	}
+
+	//the first and last entries are committed, then the server crashes without closing the spool
+	if err = s.Ack(read[0].spooled, read[2].spooled); err != nil {
+		t.Fatal("could not ack:", err)
+	}
+
+	s, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not reopen spool:", err)
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("expected 1 pending entry, got %d", n)
+	}
+	e, err := s.Next()
+	if err != nil {
+		t.Fatal("could not read spool:", err)
+	}
+	if e.Serial != "SERIAL2" {
+		t.Errorf("expected only uncommitted SERIAL2 to be replayed, got %s", e.Serial)
+	}
+
+	//the replayed segment and its acks are removed once it's committed
+	if err = s.Ack(e.spooled); err != nil {
+		t.Fatal("could not ack:", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal("could not close spool:", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected empty spool directory, got %v", files)
+	}
+}
+
+func TestDBSpoolFinalFlush(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+
+	//entries are only written by the final flush when the DB is closed
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: time.Hour, Spool: s})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	push(t, db,
+		&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()},
+		&Entry{UID: 502, Username: "bob", Serial: "SERIAL2", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: time.Now()},
+	)
+	//wait for the feeder to read both entries
+	read := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.readFrom
+	}
+	for deadline := time.Now().Add(time.Second); read() != 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("could not close db:", err)
+	}
+
+	if s, err = OpenSpool(dir); err != nil {
+		t.Fatal("could not reopen spool:", err)
+	}
+	defer s.Close()
+	if n := s.Len(); n != 0 {
+		t.Errorf("expected entries written by the final flush to be committed, got %d pending", n)
+	}
+}
+
+func TestDBSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+
+	//entry left over from a previous run
+	if err = s.Append(&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()}); err != nil {
+		t.Fatal("could not append:", err)
+	}
+
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: testWriteInterval, Spool: s})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	defer db.Close()
+	push(t, db, &Entry{UID: 502, Username: "bob", Serial: "SERIAL2", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: time.Now()})
+
+	waitForRows(t, db, "log", 2)
+	for deadline := time.Now().Add(time.Second); s.Len() != 0 && time.Now().Before(deadline); time.Sleep(testWriteInterval) {
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("expected empty spool, got %d entries", n)
+	}
+}
+
+func TestDBSpoolReadError(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal("could not open spool:", err)
+	}
+	if err = s.Append(&Entry{UID: 501, Username: "alice", Serial: "SERIAL1", IP: "10.0.0.1", InternetIP: "1.2.3.4", Time: time.Now()}); err != nil {
+		t.Fatal("could not append:", err)
+	}
+	if err = s.Rotate(); err != nil {
+		t.Fatal("could not rotate:", err)
+	}
+
+	//the first segment can't be read until it's moved back
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err = os.Rename(segmentName(dir, 1), moved); err != nil {
+		t.Fatal("could not move segment:", err)
+	}
+
+	db, err := NewDB("sqlite", filepath.Join(t.TempDir(), "chronicle.db"), &Options{Workers: 2, WriteInterval: testWriteInterval, Spool: s})
+	if err != nil {
+		t.Fatal("could not create db:", err)
+	}
+	defer db.Close()
+	push(t, db, &Entry{UID: 502, Username: "bob", Serial: "SERIAL2", IP: "10.0.0.2", InternetIP: "1.2.3.4", Time: time.Now()})
+
+	time.Sleep(2 * minFeederBackoff)
+	if err = os.Rename(moved, segmentName(dir, 1)); err != nil {
+		t.Fatal("could not move segment back:", err)
+	}
+	waitForRows(t, db, "log", 2)
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientCertMode is whether clients must present a certificate verified against the client CA bundle
+type ClientCertMode string
+
+// Client certificate modes
+const (
+	// ClientCertOff doesn't request client certificates
+	ClientCertOff ClientCertMode = "off"
+	// ClientCertOptional verifies client certificates if they're presented
+	ClientCertOptional ClientCertMode = "optional"
+	// ClientCertRequire rejects connections without a verified client certificate
+	ClientCertRequire ClientCertMode = "require"
+)
+
+// ParseClientCertMode parses a ClientCertMode. An empty string is ClientCertOff
+func ParseClientCertMode(s string) (ClientCertMode, error) {
+	switch m := ClientCertMode(s); m {
+	case "":
+		return ClientCertOff, nil
+	case ClientCertOff, ClientCertOptional, ClientCertRequire:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown client certificate mode: %s", s)
+}
+
+// ClientCertAttribute is the attribute set to the subject of the request's verified client certificate on submitted entries.
+// Submitted values for it are always removed
+const ClientCertAttribute = "chronicle.client_cert"
+
+// defaultCertCheckInterval is how often CertReloader checks its files for changes if not configured
+const defaultCertCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate and key loaded from files, reloading them when either file changes.
+// If reloading fails, the previous certificate is served until the files are fixed
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	nextCheck time.Time
+}
+
+// NewCertReloader returns a new CertReloader for certFile and keyFile that checks them for changes every interval; default: 10 seconds
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	if interval <= 0 {
+		interval = defaultCertCheckInterval
+	}
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.load(modTime); err != nil {
+		return nil, err
+	}
+	c.nextCheck = time.Now().Add(interval)
+	return c, nil
+}
+
+// modified returns the latest modification time of the certificate and key files
+func (c *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not stat %s: %w", path, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load loads the certificate and key files, which were last modified at modTime
+func (c *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed. It's used as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.After(c.nextCheck) {
+		c.nextCheck = now.Add(c.interval)
+		modTime, err := c.modified()
+		if err != nil {
+			log.Println("Error checking certificate:", err)
+		} else if !modTime.Equal(c.modTime) {
+			if err = c.load(modTime); err != nil {
+				log.Println("Error reloading certificate:", err)
+			} else {
+				log.Println("Reloaded certificate from", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// ErrNoClientCAs is returned by TLSConfig if client certificates are verified without a CA bundle
+var ErrNoClientCAs = errors.New("client certificates require a CA bundle")
+
+// TLSConfig returns a tls.Config serving certificates from reloader. If mode isn't ClientCertOff,
+// client certificates are verified against the PEM CA bundle in caFile
+func TLSConfig(reloader *CertReloader, mode ClientCertMode, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	switch mode {
+	case ClientCertOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return config, nil
+	}
+
+	if caFile == "" {
+		return nil, ErrNoClientCAs
+	}
+	buf, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+	return config, nil
+}
+
+// ClientCert returns r's verified client certificate, or nil if it didn't present one
+func ClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// ClientSubject returns the subject of r's verified client certificate, or an empty string if it didn't present one
+func ClientSubject(r *http.Request) string {
+	cert := ClientCert(r)
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.String()
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert generates a certificate for subject with the given serial number, signed by parent or self-signed if parent is nil
+func newTestCert(t *testing.T, subject string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("could not generate key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: subject, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal("could not create certificate:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("could not parse certificate:", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes c's certificate and key as PEM to certFile and keyFile
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal("could not marshal key:", err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal("could not write certificate:", err)
+	}
+	if keyFile == "" {
+		return
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal("could not write key:", err)
+	}
+}
+
+// tlsCert returns c as a tls.Certificate
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "server", 1, nil).write(t, certFile, keyFile)
+
+	reloader, err := NewCertReloader(certFile, keyFile, time.Millisecond)
+	if err != nil {
+		t.Fatal("could not create reloader:", err)
+	}
+	serial := func() int64 {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal("could not get certificate:", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal("could not parse certificate:", err)
+		}
+		return parsed.SerialNumber.Int64()
+	}
+	if s := serial(); s != 1 {
+		t.Fatalf("expected serial 1, got %d", s)
+	}
+
+	touch := func(offset time.Duration) {
+		for _, path := range []string{certFile, keyFile} {
+			if err := os.Chtimes(path, time.Now().Add(offset), time.Now().Add(offset)); err != nil {
+				t.Fatal("could not change file times:", err)
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	newTestCert(t, "server", 2, nil).write(t, certFile, keyFile)
+	touch(time.Minute)
+	if s := serial(); s != 2 {
+		t.Errorf("expected reloaded serial 2, got %d", s)
+	}
+
+	if err = os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal("could not write key:", err)
+	}
+	touch(2 * time.Minute)
+	if s := serial(); s != 2 {
+		t.Errorf("expected previous serial 2 to be kept after failed reload, got %d", s)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca.write(t, caFile, "")
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "server", 2, ca).write(t, certFile, keyFile)
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal("could not create reloader:", err)
+	}
+
+	if _, err = TLSConfig(reloader, ClientCertOptional, ""); err != ErrNoClientCAs {
+		t.Errorf("expected ErrNoClientCAs, got %v", err)
+	}
+
+	client := newTestCert(t, "SERIAL1", 3, ca).tlsCert()
+	untrusted := newTestCert(t, "SERIAL2", 4, nil).tlsCert()
+
+	for _, test := range []struct {
+		mode    ClientCertMode
+		cert    *tls.Certificate
+		subject string
+		fails   bool
+	}{
+		{ClientCertOptional, &client, "CN=SERIAL1,O=Example", false},
+		{ClientCertOptional, nil, "", false},
+		{ClientCertOptional, &untrusted, "", true},
+		{ClientCertRequire, &client, "CN=SERIAL1,O=Example", false},
+		{ClientCertRequire, nil, "", true},
+	} {
+		config, err := TLSConfig(reloader, test.mode, caFile)
+		if err != nil {
+			t.Fatal("could not create config:", err)
+		}
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, ClientSubject(r))
+		}))
+		//StartTLS would replace the reloader with its own certificate
+		s.Listener = tls.NewListener(s.Listener, config)
+		s.Start()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		clientConfig := &tls.Config{RootCAs: roots}
+		if test.cert != nil {
+			//always send the certificate, even if it's not signed by a CA the server accepts
+			cert := test.cert
+			clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}).Get("https://" + s.Listener.Addr().String())
+		if test.fails {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected request to fail", test.mode)
+			}
+			s.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not make request: %v", test.mode, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.Close()
+		if err != nil {
+			t.Fatal("could not read body:", err)
+		}
+		if string(body) != test.subject {
+			t.Errorf("%s: expected subject %q, got %q", test.mode, test.subject, body)
+		}
+	}
+}
+
+func TestMarkClientCert(t *testing.T) {
+	c := &Context{ClientCerts: true}
+	cert := newTestCert(t, "SERIAL1", 1, nil).cert
+
+	r := httptest.NewRequest("POST", "/api/v2/submit", nil)
+	e := &Entry{Attributes: map[string]string{ClientCertAttribute: "CN=spoofed"}}
+	e.removeReservedAttributes()
+	c.markClientCert(e, r)
+	if v, ok := e.Attributes[ClientCertAttribute]; ok {
+		t.Errorf("expected submitted attribute to be removed, got %q", v)
+	}
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	c.markClientCert(e, r)
+	if v := e.Attributes[ClientCertAttribute]; v != "CN=SERIAL1,O=Example" {
+		t.Errorf("expected subject attribute, got %q", v)
+	}
+}
@@ -9,16 +9,55 @@ import (
 
 // Config represents options given in the environment
 type Config struct {
-	SQLDriver string //required
+	SQLDriver string //required; mysql, postgres, or sqlite
 	SQLDSN    string //required
 
-	APIKey string
+	AutoMigrate bool `default:"true"` //apply schema migrations at startup; default: true
+
+	APIKey          string   //key with the query and export scopes, in addition to keys created with chronicle-server keys
+	AnonymousScopes []string `default:"submit"` //scopes allowed without an api key; submit, query, export, or admin; default: submit
+
+	ClockSkew   int //in seconds; how far in the future a batch submitted entry's time can be; default: 300; disabled if < 0
+	MaxBackdate int //in hours; how far in the past a batch submitted entry's time can be; default: 168; disabled if < 0
 
 	Workers       int //default: 10
 	WriteInterval int //in seconds; default:15s
+	MaxAttempts   int //times to retry an entry before it's dead-lettered; default: 5
+	BatchSize     int //max log entries written per INSERT; default: most allowed by driver
+
+	CacheSize   int //max user, device, address, and identity IDs kept in memory; default: 100000
+	CacheWarmup int //in hours; preload IDs of identities active in this window at startup; disabled if 0
+
+	SessionGap int //in minutes; longest time between check-ins in the same session; disabled if 0
+
+	DeviceTokens string //what to do with submitted entries without a valid device token for their serial: off, flag, or reject; default: off
+
+	SigningKeys     map[string]string //HMAC keys for signed submit requests by name, e.g. default:secret,site1:secret; disabled if empty
+	Signatures      string            //what to do with unsigned submit requests: accept, flag, or reject; default: accept
+	SignatureWindow int               //in seconds; how far a signature's timestamp can be from the server's time; default: 300
+
+	FieldPolicy       map[string]string //policy for fields that are too long by JSON field name, e.g. hostname:truncate,full_name:hash; reject, truncate, or hash; default: reject
+	TrimSpace         bool              //trim whitespace from submitted fields
+	LowercaseHostname bool              //convert submitted hostnames to lowercase
+	StripDomains      []string          //domain suffixes to remove from submitted hostnames, e.g. local,example.com
+
+	ExcludeUsers    []string `default:"administrator,root"` //usernames skipped by last user queries; default: administrator,root
+	ExcludePrefixes []string //username prefixes skipped by last user queries, e.g. svc_,admin-
+	ExcludeUIDs     string   //UIDs and inclusive UID ranges skipped by last user queries, e.g. 0-499,65534
+
+	LookupTolerance int //in minutes; default window searched before and after the queried time by IP lookups; default: 60
+
+	SpoolDir string //directory to spool entries to until they're committed; disabled if empty
 
 	ListenAddr string //addr format used for net.Dial; required
 	Prefix     string //url prefix to mount api to without trailing slash
+
+	TrustedProxies []string `default:"127.0.0.1,::1"` //CIDRs of proxies trusted to send Forwarded, X-Forwarded-For, and X-Real-IP headers; default: 127.0.0.1,::1
+
+	TLSCert     string //path to a PEM certificate (with any intermediates) to serve HTTPS with; reloaded when changed; plain HTTP if empty
+	TLSKey      string //path to the PEM private key for TLSCert
+	ClientCA    string //path to a PEM CA bundle client certificates are verified against
+	ClientCerts string //whether clients present a certificate: off, optional, or require; default: off
 }
 
 var config = &Config{}
@@ -50,5 +89,19 @@ func init() {
 		config.WriteInterval = 15
 	}
 
-	checkEmpty(config.ListenAddr, "LISTENADDR")
+	if config.ClockSkew == 0 {
+		config.ClockSkew = 300
+	}
+
+	if config.MaxBackdate == 0 {
+		config.MaxBackdate = 168
+	}
+
+	if config.LookupTolerance == 0 {
+		config.LookupTolerance = 60
+	}
+
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 5
+	}
 }
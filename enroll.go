@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/korylprince/chronicle-server/api"
+)
+
+const enrollUsage = "usage: %s enroll create [-count n] [-expires 168h] | enroll revoke SERIAL"
+
+// enroll runs the given device enrollment command against the configured database
+func enroll(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(enrollUsage, os.Args[0])
+	}
+
+	db, err := api.OpenDB(config.SQLDriver, config.SQLDSN, config.AutoMigrate)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "create":
+		flags := flag.NewFlagSet("enroll create", flag.ContinueOnError)
+		count := flags.Int("count", 1, "number of one-time secrets to create")
+		expires := flags.Duration("expires", 0, "how long until the secrets expire; never if 0")
+		if err = flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+		for i := 0; i < *count; i++ {
+			secret, err := db.CreateEnrollmentSecret(expiresAt)
+			if err != nil {
+				return err
+			}
+			fmt.Println(secret)
+		}
+	case args[0] == "revoke" && len(args) == 2:
+		return db.RevokeDeviceToken(args[1])
+	default:
+		return fmt.Errorf(enrollUsage, os.Args[0])
+	}
+
+	return nil
+}
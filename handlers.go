@@ -2,19 +2,23 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
+
+	"github.com/korylprince/chronicle-server/api"
+	"github.com/thoas/stats"
 )
 
 type forwardedHandler struct {
-	chain http.Handler
+	chain   http.Handler
+	proxies api.TrustedProxies
 }
 
-// ForwardedHandler replaces the Remote Address with the X-Forwarded-For header if it exists
-func ForwardedHandler(h http.Handler) http.Handler {
-	return forwardedHandler{h}
+// ForwardedHandler replaces the Remote Address with the client address from the forwarded headers sent by trusted proxies.
+// Forwarded headers from untrusted peers are ignored
+func ForwardedHandler(h http.Handler, proxies api.TrustedProxies) http.Handler {
+	return forwardedHandler{chain: h, proxies: proxies}
 }
 
 func (h forwardedHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
@@ -23,19 +27,29 @@ func (h forwardedHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		log.Panicln("Error parsing Remote Address:", err)
 	}
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		r.RemoteAddr = fmt.Sprintf("%s:%s", ip, port)
+	ip, err := h.proxies.ClientIP(r)
+	if err != nil {
+		log.Panicln("Error parsing Remote Address:", err)
 	}
+	r.RemoteAddr = net.JoinHostPort(ip, port)
 
 	h.chain.ServeHTTP(rw, r)
 }
 
-// StatsHandler returns the current stats
-func StatsHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	e := json.NewEncoder(w)
-	err := e.Encode(httpstats.Data())
-	if err != nil {
-		log.Println("Error encoding data:", err)
-	}
+// statsData is the combined HTTP and DB stats
+type statsData struct {
+	*stats.Data
+	DB *api.Stats `json:"db"`
+}
+
+// StatsHandler returns an http.Handler that returns the current stats
+func StatsHandler(db *api.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		err := e.Encode(&statsData{Data: httpstats.Data(), DB: db.Stats()})
+		if err != nil {
+			log.Println("Error encoding data:", err)
+		}
+	})
 }
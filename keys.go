@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korylprince/chronicle-server/api"
+)
+
+const keysUsage = "usage: %s keys add NAME -scopes submit,query,export,admin [-expires 720h] | keys list | keys revoke NAME"
+
+// keys runs the given API key command against the configured database
+func keys(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(keysUsage, os.Args[0])
+	}
+
+	db, err := api.OpenDB(config.SQLDriver, config.SQLDSN, config.AutoMigrate)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "add" && len(args) >= 2:
+		flags := flag.NewFlagSet("keys add", flag.ContinueOnError)
+		scopeList := flags.String("scopes", "", "comma separated scopes: submit, query, export, or admin")
+		expires := flags.Duration("expires", 0, "how long until the key expires; never if 0")
+		if err = flags.Parse(args[2:]); err != nil {
+			return err
+		}
+		scopes, err := api.ParseScopes(strings.Split(*scopeList, ","))
+		if err != nil {
+			return err
+		}
+		if len(scopes) == 0 {
+			return fmt.Errorf("at least one scope is required")
+		}
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+
+		key, _, err := db.CreateAPIKey(args[1], scopes, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+	case args[0] == "list" && len(args) == 1:
+		list, err := db.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSCOPES\tCREATED\tEXPIRES\tSTATUS")
+		now := time.Now()
+		for _, k := range list {
+			expires, status := "never", "active"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+			}
+			if k.Expired(now) {
+				status = "expired"
+			}
+			if k.Revoked {
+				status = "revoked"
+			}
+			scopes := make([]string, len(k.Scopes))
+			for idx, s := range k.Scopes {
+				scopes[idx] = string(s)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.Name, strings.Join(scopes, ","), k.CreatedAt.Format(time.RFC3339), expires, status)
+		}
+		return w.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		return db.RevokeAPIKey(args[1])
+	default:
+		return fmt.Errorf(keysUsage, os.Args[0])
+	}
+
+	return nil
+}
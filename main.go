@@ -3,18 +3,27 @@ package main
 //go:generate go-bindata-assetfs static/...
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/korylprince/chronicle-server/api"
+	_ "github.com/lib/pq"
 	"github.com/thoas/stats"
+	_ "modernc.org/sqlite"
 )
 
+// shutdownTimeout is how long to wait for in-flight requests to finish when shutting down
+const shutdownTimeout = 5 * time.Second
+
 var httpstats *stats.Stats
 
 func init() {
@@ -22,37 +31,197 @@ func init() {
 }
 
 // middleware
-func middleware(h http.Handler) http.Handler {
+func middleware(h http.Handler, proxies api.TrustedProxies) http.Handler {
 	return httpstats.Handler(handlers.CombinedLoggingHandler(os.Stdout,
 		handlers.CompressHandler(
 			handlers.CORS(
 				handlers.AllowedOrigins([]string{"*"}),
 				handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"}),
-				handlers.AllowedHeaders([]string{"Accept", "Content-Type", "Origin"}),
+				handlers.AllowedHeaders([]string{"Accept", "Authorization", "Content-Type", "Origin", api.DeviceTokenHeader,
+					api.SignatureHeader, api.SignatureTimestampHeader, api.SignatureKeyHeader}),
 			)(
 				http.StripPrefix(config.Prefix,
-					ForwardedHandler(h))))))
+					ForwardedHandler(h, proxies))))))
 }
 
 func main() {
-	db, err := api.NewDB(config.SQLDriver, config.SQLDSN, config.Workers, time.Duration(config.WriteInterval)*time.Second)
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	checkEmpty(config.ListenAddr, "LISTENADDR")
+
+	if config.AutoMigrate {
+		if err := migrate("up"); err != nil {
+			log.Fatalln("Error migrating DB:", err)
+		}
+	}
+
+	var spool *api.Spool
+	if config.SpoolDir != "" {
+		var err error
+		if spool, err = api.OpenSpool(config.SpoolDir); err != nil {
+			log.Fatalln("Error opening spool:", err)
+		}
+	}
+
+	db, err := api.NewDB(config.SQLDriver, config.SQLDSN, &api.Options{
+		Workers:       config.Workers,
+		WriteInterval: time.Duration(config.WriteInterval) * time.Second,
+		Spool:         spool,
+		MaxAttempts:   config.MaxAttempts,
+		BatchSize:     config.BatchSize,
+		CacheSize:     config.CacheSize,
+		CacheWarmup:   time.Duration(config.CacheWarmup) * time.Hour,
+		SessionGap:    time.Duration(config.SessionGap) * time.Minute,
+	})
 	if err != nil {
 		log.Panicln("Error creating DB:", err)
 	}
 
+	policies, err := api.ParsePolicies(config.FieldPolicy)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_FIELDPOLICY:", err)
+	}
+
+	uidRanges, err := api.ParseUIDRanges(config.ExcludeUIDs)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_EXCLUDEUIDS:", err)
+	}
+
+	anonymous, err := api.ParseScopes(config.AnonymousScopes)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_ANONYMOUSSCOPES:", err)
+	}
+
+	tokenMode, err := api.ParseTokenMode(config.DeviceTokens)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_DEVICETOKENS:", err)
+	}
+
+	signatureMode, err := api.ParseSignatureMode(config.Signatures)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_SIGNATURES:", err)
+	}
+
+	var verifier *api.Verifier
+	if len(config.SigningKeys) > 0 {
+		verifier = api.NewVerifier(config.SigningKeys, time.Duration(config.SignatureWindow)*time.Second)
+	}
+
+	clientCerts, err := api.ParseClientCertMode(config.ClientCerts)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_CLIENTCERTS:", err)
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSCert != "" {
+		checkEmpty(config.TLSKey, "TLSKEY")
+		reloader, err := api.NewCertReloader(config.TLSCert, config.TLSKey, 0)
+		if err != nil {
+			log.Fatalln("Error loading TLS certificate:", err)
+		}
+		if tlsConfig, err = api.TLSConfig(reloader, clientCerts, config.ClientCA); err != nil {
+			log.Fatalln("Error configuring TLS:", err)
+		}
+	} else if clientCerts != api.ClientCertOff {
+		log.Fatalln("CHRONICLE_CLIENTCERTS requires CHRONICLE_TLSCERT")
+	}
+
+	proxies, err := api.ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatalln("Error parsing CHRONICLE_TRUSTEDPROXIES:", err)
+	}
+
 	c := &api.Context{
-		DB:     db,
-		APIKey: config.APIKey,
+		DB:              db,
+		Keys:            api.NewKeyStore(db, 0),
+		APIKey:          config.APIKey,
+		AnonymousScopes: anonymous,
+
+		Tokens:    api.NewTokenStore(db, 0),
+		TokenMode: tokenMode,
+
+		Signatures:    verifier,
+		SignatureMode: signatureMode,
+
+		ClientCerts: clientCerts != api.ClientCertOff,
+
+		Normalizer: &api.Normalizer{
+			Policies:          policies,
+			TrimSpace:         config.TrimSpace,
+			LowercaseHostname: config.LowercaseHostname,
+			DomainSuffixes:    config.StripDomains,
+		},
+
+		MaxClockSkew: time.Duration(config.ClockSkew) * time.Second,
+		MaxBackdate:  time.Duration(config.MaxBackdate) * time.Hour,
+
+		Exclude: &api.Exclusion{
+			Usernames: config.ExcludeUsers,
+			Prefixes:  config.ExcludePrefixes,
+			UIDRanges: uidRanges,
+		},
+
+		LookupTolerance: time.Duration(config.LookupTolerance) * time.Minute,
 	}
 
 	r := mux.NewRouter()
 
 	//api
-	r.Handle("/api/v1/submit", api.SubmitHandler(c)).Methods("POST")
-	r.Handle("/api/v1.1/submit", api.SubmitHandler(c)).Methods("POST")
-	r.Handle("/api/v1.1/stats", http.HandlerFunc(StatsHandler)).Methods("GET")
-	r.Handle("/api/v1.1/query_serial", c.HandleQueryLastUser()).Methods("POST")
+	r.Handle("/api/v1/submit", c.Authorize(api.ScopeSubmit, api.SubmitHandler(c))).Methods("POST")
+	r.Handle("/api/v1.1/submit", c.Authorize(api.ScopeSubmit, api.SubmitHandler(c))).Methods("POST")
+	r.Handle("/api/v1.1/stats", c.Authorize(api.ScopeAdmin, StatsHandler(db))).Methods("GET")
+	r.Handle("/api/v1.1/query_serial", c.Authorize(api.ScopeQuery, c.HandleQueryLastUser())).Methods("POST")
+	r.Handle("/api/v2/enroll", c.Authorize(api.ScopeSubmit, c.HandleEnroll())).Methods("POST")
+	r.Handle("/api/v2/submit", c.Authorize(api.ScopeSubmit, c.HandleSubmitBatch())).Methods("POST")
+	r.Handle("/api/v2/query_attribute", c.Authorize(api.ScopeQuery, c.HandleQueryAttribute())).Methods("POST")
+	r.Handle("/api/v2/query_history", c.Authorize(api.ScopeQuery, c.HandleQueryHistory())).Methods("POST")
+	r.Handle("/api/v2/query_ip", c.Authorize(api.ScopeQuery, c.HandleQueryIP())).Methods("POST")
+	r.Handle("/api/v2/query_user", c.Authorize(api.ScopeQuery, c.HandleQueryUser())).Methods("POST")
+	r.Handle("/api/v2/query_sessions", c.Authorize(api.ScopeQuery, c.HandleQuerySessions())).Methods("POST")
+	r.Handle("/api/v2/report_stale", c.Authorize(api.ScopeExport, c.HandleStaleReport())).Methods("GET")
+
+	server := &http.Server{Addr: config.ListenAddr, Handler: middleware(r, proxies), TLSConfig: tlsConfig}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Println("Listening on:", config.ListenAddr)
+		if tlsConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- server.ListenAndServe()
+	}()
+
+	status := 0
+	select {
+	case sig := <-sigs:
+		log.Println("Received", sig, "shutting down")
+	case err := <-errs:
+		log.Println("Error listening:", err)
+		status = 1
+	}
+
+	//stop accepting submits and wait for in-flight requests
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down server:", err)
+	}
+
+	//drain the queue and write remaining entries
+	if err := db.Close(); err != nil {
+		log.Println("Error closing DB:", err)
+		status = 1
+	}
 
-	log.Println("Listening on:", config.ListenAddr)
-	log.Println(http.ListenAndServe(config.ListenAddr, middleware(r)))
+	log.Println("Shutdown complete")
+	os.Exit(status)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korylprince/chronicle-server/api"
+)
+
+// migrate runs the given migrate command (up, down, or status) against the configured database
+func migrate(cmd string) error {
+	m, err := api.NewMigrator(config.SQLDriver, config.SQLDSN)
+	if err != nil {
+		return fmt.Errorf("could not create migrator: %w", err)
+	}
+	defer m.Close()
+
+	switch cmd {
+	case "up":
+		n, err := m.Up()
+		if err != nil {
+			return err
+		}
+		log.Println("Applied", n, "migrations")
+	case "down":
+		if err = m.Down(); err != nil {
+			if errors.Is(err, api.ErrNoMigration) {
+				log.Println("No migrations to revert")
+				return nil
+			}
+			return err
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command: %s", cmd)
+	}
+
+	return nil
+}
+
+// runCommand runs the command given on the command line
+func runCommand(args []string) error {
+	switch {
+	case args[0] == "migrate" && len(args) == 2:
+		return migrate(args[1])
+	case args[0] == "report":
+		return report(args[1:])
+	case args[0] == "keys":
+		return keys(args[1:])
+	case args[0] == "enroll":
+		return enroll(args[1:])
+	}
+	return fmt.Errorf("usage: %s [migrate up|down|status] [report stale] [keys add|list|revoke] [enroll create|revoke]", os.Args[0])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/korylprince/chronicle-server/api"
+)
+
+// report runs the given report command against the configured database, writing the report to stdout
+func report(args []string) error {
+	if len(args) == 0 || args[0] != "stale" {
+		return fmt.Errorf("usage: %s report stale [-days n] [-format csv|json]", os.Args[0])
+	}
+
+	flags := flag.NewFlagSet("report stale", flag.ContinueOnError)
+	days := flags.Int("days", 30, "report devices without an entry in this many days")
+	format := flags.String("format", "csv", "output format: csv or json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return api.ErrInvalidDays
+	}
+	if *format != "csv" && *format != "json" {
+		return api.ErrInvalidFormat
+	}
+
+	db, err := api.OpenDB(config.SQLDriver, config.SQLDSN, config.AutoMigrate)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	stale, err := db.QueryStale(time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(stale)
+	}
+	return stale.WriteCSV(os.Stdout)
+}
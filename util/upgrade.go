@@ -40,7 +40,10 @@ func init() {
 func main() {
 	log.Println("Starting")
 
-	db, err := api.NewDB(config.SQLDriver, config.SQLDSN, config.Workers, time.Duration(config.WriteInterval)*time.Millisecond)
+	db, err := api.NewDB(config.SQLDriver, config.SQLDSN, &api.Options{
+		Workers:       config.Workers,
+		WriteInterval: time.Duration(config.WriteInterval) * time.Millisecond,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -72,7 +75,9 @@ func main() {
 			panic(err)
 		}
 		e.ClientIdentifier = ci.String
-		db.Push(e)
+		if err = db.Push(e); err != nil {
+			panic(err)
+		}
 		counter++
 		if counter%int64(config.CommitAt) == 0 {
 			time.Sleep(time.Duration(config.WriteInterval) * time.Millisecond)
@@ -80,12 +85,8 @@ func main() {
 	}
 
 	log.Println("Waiting for Queue to clear")
-	for {
-		if db.QueueLen() == 0 {
-			break
-		}
-		time.Sleep(time.Second)
-		log.Println(db.QueueLen(), "left in queue")
+	if err = db.Close(); err != nil {
+		panic(err)
 	}
 	log.Println("Done")
 }